@@ -0,0 +1,268 @@
+// Command emys manages passphrase-protected emys key files, and prints the
+// known-answer test vectors of the scheme.
+//
+// Usage:
+//
+//	emys generate [-time n] [-memory KiB] [-threads n] FILE
+//	emys change-passphrase [-time n] [-memory KiB] [-threads n] FILE
+//	emys export FILE
+//	emys inspect FILE
+//	emys vectors
+//
+// Passphrases are read from the terminal without echo, or else from standard
+// input, one per line. The vectors are written to standard output as JSON,
+// and are committed in internal/emys/testdata/vectors.json.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/keyfile"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "emys:", err)
+		os.Exit(1)
+	}
+}
+
+const usage = `usage:
+	emys generate [-time n] [-memory KiB] [-threads n] FILE
+	emys change-passphrase [-time n] [-memory KiB] [-threads n] FILE
+	emys export FILE
+	emys inspect FILE
+	emys vectors`
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	cmd := &command{
+		stdin:    bufio.NewReader(stdin),
+		stdout:   stdout,
+		stderr:   stderr,
+		terminal: -1,
+	}
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		cmd.terminal = int(f.Fd())
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	params := keyfile.DefaultParams
+	var threads uint
+	switch args[0] {
+	case "generate", "change-passphrase":
+		fs.Func("time", "Argon2id passes", parseUint32(&params.Time))
+		fs.Func("memory", "Argon2id memory in KiB", parseUint32(&params.Memory))
+		fs.UintVar(&threads, "threads", uint(params.Threads), "Argon2id threads")
+	case "export", "inspect", "vectors":
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if args[0] == "vectors" {
+		if fs.NArg() != 0 {
+			return errors.New(usage)
+		}
+		return cmd.vectors()
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	if threads > 255 {
+		return fmt.Errorf("too many threads: %d", threads)
+	}
+	params.Threads = uint8(threads)
+	path := fs.Arg(0)
+	switch args[0] {
+	case "generate":
+		return cmd.generate(path, params)
+	case "change-passphrase":
+		return cmd.changePassphrase(path, params)
+	case "export":
+		return cmd.export(path)
+	default:
+		return cmd.inspect(path)
+	}
+}
+
+func parseUint32(v *uint32) func(string) error {
+	return func(s string) error {
+		_, err := fmt.Sscan(s, v)
+		return err
+	}
+}
+
+type command struct {
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// terminal is the file descriptor of stdin if it is a terminal, and -1
+	// otherwise.
+	terminal int
+}
+
+func (c *command) passphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(c.stderr, prompt)
+	if c.terminal >= 0 {
+		passphrase, err := term.ReadPassword(c.terminal)
+		fmt.Fprintln(c.stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		return passphrase, nil
+	}
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+func (c *command) newPassphrase() ([]byte, error) {
+	passphrase, err := c.passphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	confirm, err := c.passphrase("Confirm passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+func (c *command) generate(path string, params keyfile.Params) error {
+	passphrase, err := c.newPassphrase()
+	if err != nil {
+		return err
+	}
+	data, err := keyfile.Generate(passphrase, params)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+func (c *command) changePassphrase(path string, params keyfile.Params) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	f, err := keyfile.Parse(data)
+	if err != nil {
+		return err
+	}
+	old, err := c.passphrase("Current passphrase: ")
+	if err != nil {
+		return err
+	}
+	key, userNonce, err := f.Open(old)
+	if err != nil {
+		return err
+	}
+	passphrase, err := c.newPassphrase()
+	if err != nil {
+		return err
+	}
+	data, err = keyfile.Seal(key, userNonce, passphrase, params)
+	if err != nil {
+		return err
+	}
+	// The old file is only replaced once the new one is fully written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".emyskey-*")
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace key file: %w", err)
+	}
+	return nil
+}
+
+func (c *command) export(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	f, err := keyfile.Parse(data)
+	if err != nil {
+		return err
+	}
+	passphrase, err := c.passphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	key, userNonce, err := f.Open(passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "key: %s\nuser nonce: %s\n", hex.EncodeToString(key), hex.EncodeToString(userNonce))
+	return nil
+}
+
+func (c *command) inspect(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	f, err := keyfile.Parse(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "version: %d\nkdf: argon2id time=%d memory=%dKiB threads=%d\n",
+		f.Version, f.Params.Time, f.Params.Memory, f.Params.Threads)
+	return nil
+}
+
+func (c *command) vectors() error {
+	vectors, err := emys.GenerateVectors()
+	if err != nil {
+		return fmt.Errorf("failed to generate vectors: %w", err)
+	}
+	_, err = c.stdout.Write(vectors)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	params := []string{"-time", "1", "-memory", "64", "-threads", "1"}
+	run := func(stdin string, args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		err := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return stdout.String(), err
+	}
+
+	if _, err := run("pass\nother\n", append(append([]string{"generate"}, params...), path)...); err == nil {
+		t.Error("mismatched confirmation accepted")
+	}
+	if _, err := run("pass\npass\n", append(append([]string{"generate"}, params...), path)...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("pass\npass\n", append(append([]string{"generate"}, params...), path)...); err == nil {
+		t.Error("existing key file overwritten")
+	}
+	out, err := run("", "inspect", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "version: 1\nkdf: argon2id time=1 memory=64KiB threads=1\n"; out != want {
+		t.Errorf("inspect = %q, want %q", out, want)
+	}
+	exported, err := run("pass\n", "export", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("wrong\n", "export", path); err == nil {
+		t.Error("export with wrong passphrase succeeded")
+	}
+
+	if _, err := run("pass\nnew\nnew\n", append(append([]string{"change-passphrase"}, params...), path)...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("pass\n", "export", path); err == nil {
+		t.Error("old passphrase still works")
+	}
+	out, err = run("new", "export", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != exported {
+		t.Errorf("export after passphrase change = %q, want %q", out, exported)
+	}
+
+	if _, err := run("", "frobnicate", path); err == nil {
+		t.Error("unknown command accepted")
+	}
+
+	vectors, err := run("", "vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("../../internal/emys/testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vectors != string(committed) {
+		t.Error("vectors differ from the committed ones")
+	}
+	if _, err := run("", "vectors", path); err == nil {
+		t.Error("vectors accepted a file argument")
+	}
+}
@@ -1,52 +1,82 @@
 package ahe
 
 import (
-	"crypto/rand"
 	"fmt"
-	"math/big"
+	"io"
 
-	"filippo.io/bigmod"
 	"github.com/zeebo/blake3"
-)
-
-const BlockSize = 33
 
-var (
-	bigModulus *big.Int
-	modulus    *bigmod.Modulus
+	"interrato.dev/emys/internal/field"
 )
 
-func init() {
-	var err error
-	x := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), nil)
-	y := new(big.Int).Exp(big.NewInt(2), big.NewInt(96), nil)
-	bigModulus = new(big.Int).Add(x, y)
-	bigModulus.Sub(bigModulus, big.NewInt(1))
-	modulus, err = bigmod.NewModulus(bigModulus.Bytes())
+const BlockSize = field.Size
+
+func KeyFromSeed(seed []byte, blocks uint64) (key []byte, err error) {
+	ks, err := NewKeyStream(seed)
 	if err != nil {
-		panic(fmt.Sprintf("ahe: failed to initialize modulus: %v", err))
+		return nil, err
 	}
-	if size := (modulus.BitLen() + 7) / 8; size != BlockSize {
-		panic(fmt.Sprintf("ahe: modulus size does not match BlockSize: %d", size))
+	key = make([]byte, BlockSize*blocks)
+	for i := range blocks {
+		ks.next(key[i*BlockSize : (i+1)*BlockSize])
 	}
+	return key, nil
 }
 
-func KeyFromSeed(seed []byte, blocks uint64) (key []byte, err error) {
+// KeyStream yields the key of KeyFromSeed one block at a time, so that an
+// index can be encrypted or decrypted in place without ever holding its key.
+type KeyStream struct {
+	xof io.Reader
+}
+
+func NewKeyStream(seed []byte) (*KeyStream, error) {
 	if len(seed) < 32 {
 		return nil, fmt.Errorf("seed size must be at least 32 bytes")
 	}
-	key = make([]byte, 0, BlockSize*blocks)
 	h := blake3.New()
 	h.Write(seed)
-	xof := h.Digest()
-	for range blocks {
-		k, err := rand.Int(xof, bigModulus)
-		if err != nil {
+	return &KeyStream{xof: h.Digest()}, nil
+}
+
+// next samples a block uniformly below p by rejection, reading exactly what
+// crypto/rand.Int would, without allocating.
+func (ks *KeyStream) next(block []byte) {
+	var e field.Element
+	for {
+		if _, err := io.ReadFull(ks.xof, block); err != nil {
 			panic(err)
 		}
-		key = append(key, k.FillBytes(make([]byte, BlockSize))...)
+		block[0] &= 1
+		if _, err := e.SetBytes(block); err == nil {
+			return
+		}
+	}
+}
+
+// Add adds the next len(dst)/BlockSize key blocks to dst, encrypting it in
+// place.
+func (ks *KeyStream) Add(dst []byte) error {
+	return ks.apply(dst, field.AddSlice)
+}
+
+// Sub subtracts the next len(dst)/BlockSize key blocks from dst, decrypting it
+// in place.
+func (ks *KeyStream) Sub(dst []byte) error {
+	return ks.apply(dst, field.SubSlice)
+}
+
+func (ks *KeyStream) apply(dst []byte, op func(dst, x, y []byte) error) error {
+	if len(dst)%BlockSize != 0 {
+		return fmt.Errorf("dst is not a multiple of the block size")
+	}
+	var k [BlockSize]byte
+	for i := 0; i < len(dst); i += BlockSize {
+		ks.next(k[:])
+		if err := op(dst[i:i+BlockSize], dst[i:i+BlockSize], k[:]); err != nil {
+			return fmt.Errorf("unusable dst: %w", err)
+		}
 	}
-	return
+	return nil
 }
 
 func Encrypt(key, plaintext []byte) (ciphertext []byte, err error) {
@@ -60,16 +90,8 @@ func Encrypt(key, plaintext []byte) (ciphertext []byte, err error) {
 		return nil, fmt.Errorf("plaintext is not a multiple of the block size")
 	}
 	ciphertext = make([]byte, len(plaintext))
-	for i := range len(plaintext) / BlockSize {
-		k, err := bigmod.NewNat().SetBytes(key[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return nil, fmt.Errorf("unusable key: %w", err)
-		}
-		p, err := bigmod.NewNat().SetBytes(plaintext[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return nil, fmt.Errorf("unusable plaintext: %w", err)
-		}
-		copy(ciphertext[i*BlockSize:(i+1)*BlockSize], p.Add(k, modulus).Bytes(modulus))
+	if err := field.AddSlice(ciphertext, plaintext, key); err != nil {
+		return nil, fmt.Errorf("unusable key or plaintext: %w", err)
 	}
 	return ciphertext, nil
 }
@@ -85,16 +107,8 @@ func Decrypt(key, ciphertext []byte) (plaintext []byte, err error) {
 		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
 	}
 	plaintext = make([]byte, len(ciphertext))
-	for i := range len(ciphertext) / BlockSize {
-		k, err := bigmod.NewNat().SetBytes(key[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return nil, fmt.Errorf("unusable key: %w", err)
-		}
-		c, err := bigmod.NewNat().SetBytes(ciphertext[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return nil, fmt.Errorf("unusable ciphertext: %w", err)
-		}
-		copy(plaintext[i*BlockSize:(i+1)*BlockSize], c.Sub(k, modulus).Bytes(modulus))
+	if err := field.SubSlice(plaintext, ciphertext, key); err != nil {
+		return nil, fmt.Errorf("unusable key or ciphertext: %w", err)
 	}
 	return plaintext, nil
 }
@@ -109,16 +123,21 @@ func Add(dst, src []byte) error {
 	if len(src)%BlockSize != 0 {
 		return fmt.Errorf("src is not a multiple of the block size")
 	}
-	for i := range len(src) / BlockSize {
-		out, err := bigmod.NewNat().SetBytes(dst[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return fmt.Errorf("unusable dst: %w", err)
-		}
-		in, err := bigmod.NewNat().SetBytes(src[i*BlockSize:(i+1)*BlockSize], modulus)
-		if err != nil {
-			return fmt.Errorf("unusable src: %w", err)
-		}
-		copy(dst[i*BlockSize:(i+1)*BlockSize], out.Add(in, modulus).Bytes(modulus))
+	if err := field.AddSlice(dst, dst, src); err != nil {
+		return fmt.Errorf("unusable dst or src: %w", err)
+	}
+	return nil
+}
+
+func Sub(dst, src []byte) error {
+	if len(dst) != len(src) {
+		return fmt.Errorf("dst and src have different lengths")
+	}
+	if len(dst)%BlockSize != 0 {
+		return fmt.Errorf("dst is not a multiple of the block size")
+	}
+	if err := field.SubSlice(dst, dst, src); err != nil {
+		return fmt.Errorf("unusable dst or src: %w", err)
 	}
 	return nil
 }
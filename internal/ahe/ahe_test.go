@@ -99,3 +99,46 @@ func TestEncryptDecrypt(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyStream(t *testing.T) {
+	seed := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	key, err := ahe.KeyFromSeed(seed, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, len(key))
+	for i := range plaintext {
+		if i%ahe.BlockSize != 0 {
+			plaintext[i] = byte(i)
+		}
+	}
+	want, err := ahe.Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := ahe.NewKeyStream(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Clone(plaintext)
+	for _, chunk := range [][]byte{buf[:ahe.BlockSize], buf[ahe.BlockSize : 3*ahe.BlockSize], buf[3*ahe.BlockSize:]} {
+		if err := ks.Add(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf, want) {
+		t.Errorf("KeyStream.Add = %x, want %x", buf, want)
+	}
+
+	ks, err = ahe.NewKeyStream(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Sub(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, plaintext) {
+		t.Errorf("KeyStream.Sub = %x, want %x", buf, plaintext)
+	}
+}
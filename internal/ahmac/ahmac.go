@@ -3,96 +3,111 @@ package ahmac
 import (
 	"crypto/rand"
 	"fmt"
-	"math/big"
 
-	"filippo.io/bigmod"
 	"github.com/zeebo/blake3"
-)
-
-const Size = 33
 
-var (
-	bigModulus *big.Int
-	modulus    *bigmod.Modulus
+	"interrato.dev/emys/internal/field"
 )
 
-func init() {
-	var err error
-	x := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), nil)
-	y := new(big.Int).Exp(big.NewInt(2), big.NewInt(96), nil)
-	bigModulus = new(big.Int).Add(x, y)
-	bigModulus.Sub(bigModulus, big.NewInt(1))
-	if !bigModulus.ProbablyPrime(32) {
-		panic("ahmac: modulus is not prime")
-	}
-	modulus, err = bigmod.NewModulus(bigModulus.Bytes())
-	if err != nil {
-		panic(fmt.Sprintf("ahmac: failed to initialize modulus: %v", err))
-	}
-	if size := (modulus.BitLen() + 7) / 8; size != Size {
-		panic(fmt.Sprintf("ahmac: modulus size does not match Size: %d", size))
-	}
-}
+const Size = field.Size
 
 func UniformKey(key []byte) []byte {
 	h := blake3.New()
 	h.Write(key)
-	k, err := rand.Int(h.Digest(), bigModulus)
+	k, err := rand.Int(h.Digest(), field.Modulus())
 	if err != nil {
 		panic(err)
 	}
 	return k.FillBytes(make([]byte, Size))
 }
 
-var bigZero = big.NewInt(0)
-
 func MAC(ikey, akey, message []byte) (tag []byte, err error) {
+	if len(message)%Size != 0 {
+		return nil, fmt.Errorf("message is not a multiple of the block size")
+	}
+	h, err := New(ikey, akey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.Write(message); err != nil {
+		return nil, err
+	}
+	return h.Sum()
+}
+
+// Hash computes the same tag as MAC over a message written in pieces of any
+// length, holding at most one partial block.
+type Hash struct {
+	ik, ak, t field.Element
+	buf       [Size]byte
+	n         int
+}
+
+func New(ikey, akey []byte) (*Hash, error) {
 	if len(ikey) != Size {
 		return nil, fmt.Errorf("integrity key size must be exactly 33 bytes")
 	}
 	if len(akey) != Size {
 		return nil, fmt.Errorf("authentication key size must be exactly 33 bytes")
 	}
-
-	if len(message)%Size != 0 {
-		return nil, fmt.Errorf("message is not a multiple of the block size")
-	}
-	ik, err := bigmod.NewNat().SetBytes(ikey, modulus)
-	if err != nil {
+	h := new(Hash)
+	if _, err := h.ik.SetBytes(ikey); err != nil {
 		return nil, fmt.Errorf("unusable integrity key: %w", err)
 	}
-	ak, err := bigmod.NewNat().SetBytes(akey, modulus)
-	if err != nil {
+	if _, err := h.ak.SetBytes(akey); err != nil {
 		return nil, fmt.Errorf("unusable authentication key: %w", err)
 	}
-	t, err := bigmod.NewNat().SetBytes(bigZero.Bytes(), modulus)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize tag: %w", err)
-	}
-	for i := range len(message) / Size {
-		block, err := bigmod.NewNat().SetBytes(message[i*Size:(i+1)*Size], modulus)
-		if err != nil {
-			return nil, fmt.Errorf("unusable message: %w", err)
+	return h, nil
+}
+
+func (h *Hash) Write(p []byte) (int, error) {
+	written := len(p)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < Size {
+			return written, nil
 		}
-		t.Add(block, modulus)
-		t.Mul(ik, modulus)
+		if _, err := h.t.Horner(&h.ik, h.buf[:]); err != nil {
+			return 0, fmt.Errorf("unusable message: %w", err)
+		}
+		h.n = 0
+	}
+	full := len(p) - len(p)%Size
+	if _, err := h.t.Horner(&h.ik, p[:full]); err != nil {
+		return 0, fmt.Errorf("unusable message: %w", err)
 	}
-	t.Add(ak, modulus)
-	return t.Bytes(modulus), nil
+	h.n = copy(h.buf[:], p[full:])
+	return written, nil
 }
 
+// Sum returns the tag of the message written so far, which must be a whole
+// number of blocks.
+func (h *Hash) Sum() ([]byte, error) {
+	if h.n != 0 {
+		return nil, fmt.Errorf("message is not a multiple of the block size")
+	}
+	return new(field.Element).Add(&h.t, &h.ak).Bytes(), nil
+}
+
+// Add sets dst = dst + src, where src may be a shorter big-endian encoding.
 func Add(dst, src []byte) error {
-	if len(dst) < Size {
-		return fmt.Errorf("dst too short")
+	if len(dst) != Size {
+		return fmt.Errorf("dst must be exactly %d bytes", Size)
 	}
-	out, err := bigmod.NewNat().SetBytes(dst, modulus)
-	if err != nil {
+	if len(src) > Size {
+		return fmt.Errorf("src too long")
+	}
+	var out, in field.Element
+	if _, err := out.SetBytes(dst); err != nil {
 		return fmt.Errorf("unusable dst: %w", err)
 	}
-	in, err := bigmod.NewNat().SetBytes(src, modulus)
-	if err != nil {
+	padded := make([]byte, Size)
+	copy(padded[Size-len(src):], src)
+	if _, err := in.SetBytes(padded); err != nil {
 		return fmt.Errorf("unusable src: %w", err)
 	}
-	copy(dst, out.Add(in, modulus).Bytes(modulus))
+	out.Add(&out, &in).FillBytes(dst)
 	return nil
 }
@@ -60,3 +60,45 @@ func TestAdd(t *testing.T) {
 		t.Errorf("Add(%x, %x) = %x, want %x", x, y, z, want)
 	}
 }
+
+func TestHash(t *testing.T) {
+	ikey := ahmac.UniformKey([]byte("YELLOW SUBMARINE, BLACK WIZARDRY"))
+	akey := ahmac.UniformKey([]byte("BLACK WIZARDRY, YELLOW SUBMARINE"))
+	msg := make([]byte, 5*ahmac.Size)
+	for i := range msg {
+		if i%ahmac.Size != 0 {
+			msg[i] = byte(i * 7)
+		}
+	}
+	want, err := ahmac.MAC(ikey, akey, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, piece := range []int{1, 10, ahmac.Size, 50, len(msg)} {
+		h, err := ahmac.New(ikey, akey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(msg); i += piece {
+			if _, err := h.Write(msg[i:min(i+piece, len(msg))]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tag, err := h.Sum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tag, want) {
+			t.Errorf("pieces of %d: Sum() = %x, want %x", piece, tag, want)
+		}
+	}
+
+	h, err := ahmac.New(ikey, akey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(msg[:ahmac.Size+1])
+	if _, err := h.Sum(); err == nil {
+		t.Error("Sum accepted a partial block")
+	}
+}
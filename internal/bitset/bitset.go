@@ -1,30 +1,13 @@
 package bitset
 
 import (
+	"encoding/binary"
 	"fmt"
-	"math/big"
 
-	"filippo.io/bigmod"
+	"interrato.dev/emys/internal/field"
 )
 
-const blockSize = 33
-
-var modulus *bigmod.Modulus
-
-func init() {
-	var err error
-	x := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), nil)
-	y := new(big.Int).Exp(big.NewInt(2), big.NewInt(96), nil)
-	mod := new(big.Int).Add(x, y)
-	mod.Sub(mod, big.NewInt(1))
-	modulus, err = bigmod.NewModulus(mod.Bytes())
-	if err != nil {
-		panic(fmt.Sprintf("bitset: failed to initialize modulus: %v", err))
-	}
-	if size := (modulus.BitLen() + 7) / 8; size != blockSize {
-		panic(fmt.Sprintf("bitset: modulus size does not match BlockSize: %d", size))
-	}
-}
+const blockSize = field.Size
 
 type BitSet struct {
 	len uint64
@@ -73,20 +56,91 @@ func (b *BitSet) BitsAt(i, n uint64) ([]byte, error) {
 	return out, nil
 }
 
-var bigZero = big.NewInt(0)
+// Uint64At returns the n ≤ 64 bits starting at index i as an integer, bit i
+// being the least significant one.
+func (b *BitSet) Uint64At(i, n uint64) (uint64, error) {
+	if n > 64 {
+		return 0, fmt.Errorf("too many bits for an integer: %d", n)
+	}
+	bits, err := b.BitsAt(i, n)
+	if err != nil {
+		return 0, err
+	}
+	var out uint64
+	for _, x := range bits {
+		out = out<<8 | uint64(x)
+	}
+	return out, nil
+}
 
-func (b *BitSet) Neg() error {
-	blocks := (b.len + 255) / 256
-	for i := range blocks {
-		num, err := bigmod.NewNat().SetBytes(b.set[i*blockSize:(i+1)*blockSize], modulus)
-		if err != nil {
-			return fmt.Errorf("unusable bitset block %d: %w", i, err)
+// Layout packs counters of any width into 256-bit blocks, as many as fit in
+// each, so that no counter straddles two blocks. The top 256 mod Width bits
+// of every block are left unused.
+type Layout struct {
+	Counters uint64
+	Width    uint64
+}
+
+func (l Layout) PerBlock() uint64 {
+	return 256 / l.Width
+}
+
+func (l Layout) Blocks() uint64 {
+	return (l.Counters + l.PerBlock() - 1) / l.PerBlock()
+}
+
+func (l Layout) Len() uint64 {
+	return l.Blocks() * 256
+}
+
+// Offset returns the index of the first bit of counter i.
+func (l Layout) Offset(i uint64) uint64 {
+	return i/l.PerBlock()*256 + i%l.PerBlock()*l.Width
+}
+
+// Decode calls fn with the index and value of every counter held by chunk, in
+// ascending order. Chunk is a run of whole encoded blocks, as laid out by
+// Bytes, whose last block is block first. Unlike Uint64At, it does not
+// allocate, so that large indexes can be decoded a few blocks at a time.
+func (l Layout) Decode(chunk []byte, first uint64, fn func(i, counter uint64)) error {
+	if len(chunk)%blockSize != 0 {
+		return fmt.Errorf("chunk is not a multiple of the block size")
+	}
+	if l.Width == 0 || l.Width > 64 {
+		return fmt.Errorf("invalid counter width: %d", l.Width)
+	}
+	blocks := uint64(len(chunk) / blockSize)
+	if first+blocks > l.Blocks() {
+		return fmt.Errorf("chunk out of bounds: blocks [%d, %d)", first, first+blocks)
+	}
+	mask := uint64(1)<<l.Width - 1
+	for k := range blocks {
+		end := uint64(len(chunk)) - k*blockSize
+		var w [5]uint64
+		for j := range 4 {
+			w[j] = binary.BigEndian.Uint64(chunk[end-uint64(j+1)*8 : end-uint64(j)*8])
 		}
-		neg, err := bigmod.NewNat().SetBytes(bigZero.Bytes(), modulus)
-		if err != nil {
-			return fmt.Errorf("unusable zero value: %w", err)
+		for c := range l.PerBlock() {
+			i := (first+k)*l.PerBlock() + c
+			if i >= l.Counters {
+				break
+			}
+			off := c * l.Width
+			v := w[off/64] >> (off % 64)
+			if off%64 != 0 {
+				v |= w[off/64+1] << (64 - off%64)
+			}
+			fn(i, v&mask)
 		}
-		copy(b.set[i*blockSize:(i+1)*blockSize], neg.Sub(num, modulus).Bytes(modulus))
+	}
+	return nil
+}
+
+func (b *BitSet) Neg() error {
+	blocks := (b.len + 255) / 256
+	set := b.set[:blocks*blockSize]
+	if err := field.NegSlice(set, set); err != nil {
+		return fmt.Errorf("unusable bitset: %w", err)
 	}
 	return nil
 }
@@ -2,6 +2,7 @@ package bitset_test
 
 import (
 	"bytes"
+	"math/rand/v2"
 	"testing"
 
 	"interrato.dev/emys/internal/bitset"
@@ -111,3 +112,92 @@ func TestNeg(t *testing.T) {
 		t.Errorf("got %x, want %x", b, want)
 	}
 }
+
+func TestLayout(t *testing.T) {
+	l := bitset.Layout{Counters: 100, Width: 6}
+	if got := l.PerBlock(); got != 42 {
+		t.Errorf("PerBlock() = %d, want 42", got)
+	}
+	if got := l.Blocks(); got != 3 {
+		t.Errorf("Blocks() = %d, want 3", got)
+	}
+	bs := bitset.New(l.Len())
+	for _, i := range []uint64{0, 41, 42, 99} {
+		if err := bs.Set(l.Offset(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.Set(l.Offset(i) + l.Width - 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range l.Counters {
+		got, err := bs.Uint64At(l.Offset(i), l.Width)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := uint64(0)
+		if i == 0 || i == 41 || i == 42 || i == 99 {
+			want = 0b100001
+		}
+		if got != want {
+			t.Errorf("counter %d = %b, want %b", i, got, want)
+		}
+	}
+	if got := l.Offset(42); got != 256 {
+		t.Errorf("Offset(42) = %d, want 256", got)
+	}
+	wide := bitset.Layout{Counters: 5, Width: 40}
+	bs = bitset.New(wide.Len())
+	bs.Set(wide.Offset(4) + 39)
+	if got, _ := bs.Uint64At(wide.Offset(4), 40); got != 1<<39 {
+		t.Errorf("wide counter = %x, want %x", got, uint64(1)<<39)
+	}
+}
+
+func TestLayoutDecode(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for _, l := range []bitset.Layout{
+		{Counters: 100, Width: 6},
+		{Counters: 1000, Width: 1},
+		{Counters: 13, Width: 40},
+		{Counters: 9, Width: 64},
+	} {
+		bs := bitset.New(l.Len())
+		for i := range l.Counters {
+			for j := range l.Width {
+				if r.IntN(2) == 1 {
+					if err := bs.Set(l.Offset(i) + j); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		b := bs.Bytes()
+		for _, chunkBlocks := range []uint64{1, 2, l.Blocks()} {
+			next := uint64(0)
+			for first := uint64(0); first < l.Blocks(); first += chunkBlocks {
+				last := min(first+chunkBlocks, l.Blocks())
+				chunk := b[uint64(len(b))-last*33 : uint64(len(b))-first*33]
+				err := l.Decode(chunk, first, func(i, counter uint64) {
+					if i != next {
+						t.Errorf("%+v: got counter %d, want %d", l, i, next)
+					}
+					next = i + 1
+					want, err := bs.Uint64At(l.Offset(i), l.Width)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if counter != want {
+						t.Errorf("%+v: counter %d = %x, want %x", l, i, counter, want)
+					}
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if next != l.Counters {
+				t.Errorf("%+v: decoded %d counters, want %d", l, next, l.Counters)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package emys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+// backupKey is where the server keeps the backup in its store. It is shorter
+// than internal update tokens, so it never collides with a chain entry.
+var backupKey = []byte("client state backup")
+
+const backupAdditionalData = "client state backup"
+
+type backupToken struct {
+	// Previous is the version the backup replaces.
+	Previous uint64
+	State    []byte
+}
+
+type storedBackup struct {
+	Version uint64
+	State   []byte
+}
+
+type backupState struct {
+	Version uint64
+	Epoch   uint64
+	Devices map[string]deviceState
+}
+
+// Backup returns a token asking the server to store the encrypted chains of
+// every known device, so that they can later be restored with just the key and
+// user nonce. The file cache is not part of the backup. The server only accepts it if no
+// other backup was stored since the one this client last made or restored.
+func (c *Client) Backup() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	devices := maps.Clone(c.peers)
+	if devices == nil {
+		devices = make(map[string]deviceState)
+	}
+	devices[c.device] = deviceState{Log: c.log, Chains: c.state}
+	if err := enc.Encode(backupState{Version: c.backupVersion + 1, Epoch: c.epoch, Devices: devices}); err != nil {
+		return nil, fmt.Errorf("failed to encode client state: %w", err)
+	}
+	state, err := c.sealState(clientStateKeyLabel, backupAdditionalData, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	buf.Reset()
+	enc = gob.NewEncoder(&buf)
+	if err := enc.Encode(backupToken{Previous: c.backupVersion, State: state}); err != nil {
+		return nil, fmt.Errorf("failed to encode backup token: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenBackupResult records that the server stored the backup.
+func (c *Client) OpenBackupResult(result []byte) error {
+	var version uint64
+	dec := gob.NewDecoder(bytes.NewBuffer(result))
+	if err := dec.Decode(&version); err != nil {
+		return fmt.Errorf("%w: failed to decode backup result: %w", ErrMalformedResult, err)
+	}
+	if version != c.backupVersion+1 {
+		return fmt.Errorf("server stored backup version %d, want %d", version, c.backupVersion+1)
+	}
+	c.backupVersion = version
+	return nil
+}
+
+// Restore replaces the client state with a backup returned by Server.Backup.
+// The chains of this device, as set by SetDevice, are taken from the backup
+// too, so it must not be restored on two devices.
+func (c *Client) Restore(backup []byte) error {
+	state, err := c.openBackup(backup)
+	if err != nil {
+		return err
+	}
+	devices := state.Devices
+	own := devices[c.device]
+	delete(devices, c.device)
+	if own.Chains == nil {
+		own.Chains = make(map[string]clientState)
+	}
+	c.state = own.Chains
+	c.log = own.Log
+	c.peers = devices
+	c.backupVersion = state.Version
+	c.epoch = state.Epoch
+	return nil
+}
+
+func (c *Client) openBackup(backup []byte) (backupState, error) {
+	var stored storedBackup
+	dec := gob.NewDecoder(bytes.NewBuffer(backup))
+	if err := dec.Decode(&stored); err != nil {
+		return backupState{}, fmt.Errorf("failed to decode backup: %w", err)
+	}
+	plaintext, err := c.openState(clientStateKeyLabel, backupAdditionalData, "backup", stored.State)
+	if err != nil {
+		return backupState{}, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+	var state backupState
+	dec = gob.NewDecoder(bytes.NewBuffer(plaintext))
+	if err := dec.Decode(&state); err != nil {
+		return backupState{}, fmt.Errorf("failed to decode backup: %w", err)
+	}
+	if state.Version != stored.Version {
+		return backupState{}, fmt.Errorf("backup version %d stored as version %d", state.Version, stored.Version)
+	}
+	if state.Devices == nil {
+		state.Devices = make(map[string]deviceState)
+	}
+	if len(state.Devices) > maxDevices {
+		return backupState{}, fmt.Errorf("too many devices in backup: %d", len(state.Devices))
+	}
+	for id, device := range state.Devices {
+		if device.Chains == nil {
+			device.Chains = make(map[string]clientState)
+			state.Devices[id] = device
+		}
+	}
+	return state, nil
+}
+
+// ResolveBackup stores the backup in a Backup token if it replaces the latest
+// stored one, and returns ErrStaleBackup otherwise. The check is only atomic
+// within this Server, so several servers sharing a store must not accept
+// backups concurrently.
+func (s *Server) ResolveBackup(token []byte) ([]byte, error) {
+	var tok backupToken
+	if err := decodeToken(token, maxBackupTokenSize, "backup token", &tok); err != nil {
+		return nil, err
+	}
+	s.backupMu.Lock()
+	defer s.backupMu.Unlock()
+	current, err := s.storedBackup()
+	if err != nil && !errors.Is(err, ErrNoBackup) {
+		return nil, err
+	}
+	if tok.Previous != current.Version {
+		return nil, fmt.Errorf("%w: replaces version %d, but version %d is stored", ErrStaleBackup, tok.Previous, current.Version)
+	}
+	next := storedBackup{Version: current.Version + 1, State: tok.State}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(next); err != nil {
+		return nil, fmt.Errorf("failed to encode backup: %w", err)
+	}
+	if err := s.store.Put(backupKey, Entry{EncryptedIndex: buf.Bytes()}); err != nil {
+		return nil, fmt.Errorf("failed to store backup: %w", err)
+	}
+	var result bytes.Buffer
+	enc = gob.NewEncoder(&result)
+	if err := enc.Encode(next.Version); err != nil {
+		return nil, fmt.Errorf("failed to encode backup result: %w", err)
+	}
+	return result.Bytes(), nil
+}
+
+// Backup returns the latest stored backup, to be passed to Client.Restore.
+func (s *Server) Backup() ([]byte, error) {
+	entry, ok, err := s.store.Get(backupKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if !ok {
+		return nil, ErrNoBackup
+	}
+	return entry.EncryptedIndex, nil
+}
+
+func (s *Server) storedBackup() (storedBackup, error) {
+	backup, err := s.Backup()
+	if err != nil {
+		return storedBackup{}, err
+	}
+	var stored storedBackup
+	dec := gob.NewDecoder(bytes.NewBuffer(backup))
+	if err := dec.Decode(&stored); err != nil {
+		return storedBackup{}, fmt.Errorf("failed to decode stored backup: %w", err)
+	}
+	return stored, nil
+}
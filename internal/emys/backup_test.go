@@ -0,0 +1,169 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestBackup(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	newClient := func() *emys.Client {
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(client *emys.Client, id uint64, text string) {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := func(client *emys.Client) error {
+		token, err := client.Backup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveBackup(token)
+		if err != nil {
+			return err
+		}
+		return client.OpenBackupResult(result)
+	}
+	search := func(client *emys.Client, text string) []uint64 {
+		q := &emys.Query{Text: text}
+		stok, err := client.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(q, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	if _, err := server.Backup(); !errors.Is(err, emys.ErrNoBackup) {
+		t.Fatalf("Backup() error = %v, want ErrNoBackup", err)
+	}
+
+	laptop := newClient()
+	update(laptop, 0, "hello world")
+	if err := backup(laptop); err != nil {
+		t.Fatal(err)
+	}
+
+	// A phone restores the backup, updates the index and backs it up, which
+	// leaves the laptop behind.
+	phone := newClient()
+	stored, err := server.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := phone.Restore(stored); err != nil {
+		t.Fatal(err)
+	}
+	update(phone, 1, "hello there")
+	if err := backup(phone); err != nil {
+		t.Fatal(err)
+	}
+	// The laptop is now a stale copy of the same device, so the server
+	// refuses its updates as well as its backups.
+	utoks, err := laptop.Update(sse.Change[uint64]{FileID: 2, Diff: emys.Diff(nil, []byte("hello again"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); !errors.Is(err, emys.ErrDeviceForked) {
+		t.Fatalf("stale update error = %v, want ErrDeviceForked", err)
+	}
+	if err := backup(laptop); !errors.Is(err, emys.ErrStaleBackup) {
+		t.Fatalf("stale backup error = %v, want ErrStaleBackup", err)
+	}
+
+	// The backup survives a client state round trip and a server snapshot.
+	state, err := phone.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone = newClient()
+	if err := phone.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := server.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.LoadState(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	update(phone, 3, "hello you")
+	if err := backup(phone); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := newClient()
+	stored, err = server.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.Restore(stored); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(fresh, "hello"); !slices.Equal(got, []uint64{0, 1, 3}) {
+		t.Errorf("search after restore = %v, want [0 1 3]", got)
+	}
+
+	ctok, err := fresh.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.ResolveCheck(ctok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := fresh.OpenCheck(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The laptop's stray update to "hello again" is left orphaned, but the
+	// backup itself is not reported.
+	for _, iutok := range report.Orphaned {
+		if string(iutok) == "client state backup" {
+			t.Error("backup reported as orphaned entry")
+		}
+	}
+
+	other, err := emys.NewClient(key, []byte("THIS USER IS FOR SOMEONE"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Restore(stored); err == nil {
+		t.Error("backup restored by another user")
+	}
+}
@@ -0,0 +1,325 @@
+package emys
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+
+	"interrato.dev/emys/internal/ahe"
+	"interrato.dev/emys/internal/field"
+	"interrato.dev/emys/internal/sse"
+)
+
+// CheckReport lists the inconsistencies found by a full index check.
+type CheckReport struct {
+	Trigrams   int
+	Overflowed []CounterFault // counters above 1, e.g. from double inserts
+	Negative   []CounterFault // counters below 0, e.g. from bad deletions
+	Orphaned   [][]byte       // server entries no client chain leads to
+	Broken     []ChainFault   // chains the server failed to walk
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Overflowed) == 0 && len(r.Negative) == 0 && len(r.Orphaned) == 0 && len(r.Broken) == 0
+}
+
+type CounterFault struct {
+	Trigram string
+	FileID  uint64
+	Counter int64
+}
+
+// ChainFault is a chain written by a device that the server failed to walk.
+// The counters of its trigram are not inspected.
+type ChainFault struct {
+	Trigram string
+	Device  string
+	Segment uint64
+	Reason  string
+}
+
+// Check returns a token asking the server to resolve, one by one, the chains
+// of every trigram known to any device. Resolving it compacts all chains, just
+// like searching each trigram would.
+//
+// Entries carry no key epoch, so while a rotation is in progress, those
+// already written for the next epoch are reported as orphaned. Check before
+// Rotate or after the cut-over to avoid them.
+//
+// Indexes with one-bit counters cannot be checked, and Check returns
+// ErrNarrowCounters for them.
+func (c *Client) Check() (sse.SearchToken, error) {
+	if c.config.fileBitLen() < 2 {
+		return nil, ErrNarrowCounters
+	}
+	var stok [][]searchToken
+	q := c.trigrams()
+	for _, trigram := range q {
+		stok = append(stok, c.searchTokens([]string{trigram}, c.config.segments()))
+	}
+	c.markCompacted(q, c.config.segments())
+	return encodeCheckToken(stok), nil
+}
+
+func (c *Client) OpenCheck(result sse.SearchResult) (*CheckReport, error) {
+	return c.OpenCheckContext(context.Background(), result)
+}
+
+func (c *Client) OpenCheckContext(ctx context.Context, result sse.SearchResult) (*CheckReport, error) {
+	var res checkResult
+	dec := gob.NewDecoder(bytes.NewBuffer(result))
+	if err := dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode check result: %w", ErrMalformedResult, err)
+	}
+	q := c.trigrams()
+	if len(res.Results) != len(q) {
+		return nil, fmt.Errorf("%w: covers %d trigrams, want %d", ErrMalformedResult, len(res.Results), len(q))
+	}
+	report := &CheckReport{
+		Trigrams: len(q),
+		Orphaned: res.Orphaned,
+	}
+	broken := make(map[int]bool)
+	for _, b := range res.Broken {
+		if b.Trigram < 0 || b.Trigram >= len(q) {
+			return nil, fmt.Errorf("%w: broken chain of trigram %d", ErrMalformedResult, b.Trigram)
+		}
+		chains := c.chainRefs(q[b.Trigram])
+		if b.Chain < 0 || b.Chain >= len(chains) || chains[b.Chain].seg != b.Segment {
+			return nil, fmt.Errorf("%w: broken chain %d of trigram %q", ErrMalformedResult, b.Chain, q[b.Trigram])
+		}
+		report.Broken = append(report.Broken, ChainFault{
+			Trigram: q[b.Trigram],
+			Device:  chains[b.Chain].device,
+			Segment: b.Segment,
+			Reason:  b.Reason,
+		})
+		broken[b.Trigram] = true
+	}
+	for i, trigram := range q {
+		if broken[i] {
+			continue
+		}
+		indexes, err := c.openIndexes(ctx, []string{trigram}, c.config.segments(), res.Results[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open index of trigram %q: %w", trigram, err)
+		}
+		for _, seg := range c.config.segments() {
+			index, ok := indexes[seg.Start]
+			if !ok {
+				continue
+			}
+			if err := c.inspectIndex(report, trigram, seg, index); err != nil {
+				return nil, fmt.Errorf("failed to inspect index of trigram %q: %w", trigram, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// chainRefs returns the device and segment of every chain of a trigram, in the
+// order of searchTokens.
+func (c *Client) chainRefs(trigram string) []deviceChain {
+	var refs []deviceChain
+	for _, seg := range c.config.segments() {
+		c.devices(func(device string, chains map[string]clientState) {
+			if _, ok := chains[trigram][seg.Start]; ok {
+				refs = append(refs, deviceChain{device, seg.Start})
+			}
+		})
+	}
+	return refs
+}
+
+type deviceChain struct {
+	device string
+	seg    uint64
+}
+
+// inspectIndex decodes every counter of a single-trigram segment index, one
+// block at a time. A block whose value reaches 2²⁵⁶ can only come from a
+// wrapped subtraction, so it is read as the negation of its complement. The
+// counters are then peeled off from the low end as signed digits, each
+// borrowing from the next one when it is negative, so that a block may mix
+// counters of both signs. The last counter of each block takes whatever is
+// left, including the unused bits where its overflow would end up.
+func (c *Client) inspectIndex(report *CheckReport, trigram string, seg segment, index []byte) error {
+	layout := c.config.layout(seg)
+	var negated [ahe.BlockSize]byte
+	for block := range layout.Blocks() {
+		end := uint64(len(index)) - ahe.BlockSize*block
+		b := index[end-ahe.BlockSize : end]
+		value := new(big.Int)
+		negative := b[0] != 0
+		if negative {
+			if err := field.NegSlice(negated[:], b); err != nil {
+				return fmt.Errorf("failed to negate block %d: %w", block, err)
+			}
+			value.Neg(value.SetBytes(negated[:]))
+		} else {
+			value.SetBytes(b)
+		}
+		// Digits of a positive block lie in (-2ʷ⁻¹, 2ʷ⁻¹] and those of a
+		// negative one in [-2ʷ⁻¹, 2ʷ⁻¹). Check refuses one-bit counters,
+		// whose digits would all take the sign of the block.
+		base := new(big.Int).Lsh(big.NewInt(1), uint(layout.Width))
+		half := new(big.Int).Rsh(base, 1)
+		mask := new(big.Int).Sub(base, big.NewInt(1))
+		digit := new(big.Int)
+		first := block * layout.PerBlock()
+		last := min(first+layout.PerBlock(), layout.Counters) - 1
+		for id := first; id <= last; id++ {
+			if id == last {
+				digit.Set(value)
+			} else {
+				digit.And(value, mask)
+				if cmp := digit.Cmp(half); cmp > 0 || cmp == 0 && negative {
+					digit.Sub(digit, base)
+				}
+				value.Sub(value, digit)
+				value.Rsh(value, uint(layout.Width))
+			}
+			counter := digit.Int64()
+			if !digit.IsInt64() {
+				counter = int64(digit.Sign()) * math.MaxInt64
+			}
+			switch {
+			case counter < 0:
+				report.Negative = append(report.Negative, CounterFault{
+					Trigram: trigram,
+					FileID:  seg.Start + id,
+					Counter: counter,
+				})
+			case counter > 1:
+				report.Overflowed = append(report.Overflowed, CounterFault{
+					Trigram: trigram,
+					FileID:  seg.Start + id,
+					Counter: counter,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) ResolveCheck(token sse.SearchToken) (sse.SearchResult, error) {
+	return s.ResolveCheckContext(context.Background(), token)
+}
+
+// ResolveCheckContext is like ResolveCheck, but gives up once ctx is done.
+// The chains of all trigrams are compacted together, once every one of them
+// has been walked. A trigram with a corrupt chain is left as it is, and every
+// one of its corrupt chains is listed in the result.
+func (s *Server) ResolveCheckContext(ctx context.Context, token sse.SearchToken) (sse.SearchResult, error) {
+	s.epochMu.RLock()
+	defer s.epochMu.RUnlock()
+	stok, err := decodeCheckToken(token, s.config.maxSearchChains())
+	if err != nil {
+		return nil, err
+	}
+	// Chains are checked across trigrams too, since their compactions end
+	// up in a single batch.
+	if err := s.checkSearchTokens(slices.Concat(stok...)); err != nil {
+		return nil, err
+	}
+	var res checkResult
+	heads := make(map[string]bool, len(stok))
+	err = s.transact(ctx, "compacted chains", func(get GetFunc) (*Batch, error) {
+		compaction := new(Batch)
+		for i, chains := range stok {
+			trigramRes, trigramHeads, trigramCompaction, err := s.resolveChains(ctx, get, chains)
+			if errors.Is(err, ErrCorruptChain) {
+				broken, reached, err := s.brokenChains(ctx, get, chains)
+				if err != nil {
+					return nil, err
+				}
+				for j := range broken {
+					broken[j].Trigram = i
+				}
+				for _, iutok := range reached {
+					heads[iutok] = true
+				}
+				res.Results = append(res.Results, searchResult{})
+				res.Broken = append(res.Broken, broken...)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, head := range trigramHeads {
+				heads[head] = true
+			}
+			res.Results = append(res.Results, trigramRes)
+			compaction.ops = append(compaction.ops, trigramCompaction.ops...)
+		}
+		return compaction, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.Keys(func(iutok []byte) error {
+		if !heads[string(iutok)] && !reservedKey(iutok) {
+			res.Orphaned = append(res.Orphaned, slices.Clone(iutok))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chain entries: %w", err)
+	}
+	slices.SortFunc(res.Orphaned, bytes.Compare)
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(res); err != nil {
+		return nil, fmt.Errorf("failed to encode check result: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type checkResult struct {
+	Results  []searchResult
+	Orphaned [][]byte
+	Broken   []brokenChain
+}
+
+// brokenChain is a chain of a check token, by position, with the reason its
+// walk failed.
+type brokenChain struct {
+	Trigram int
+	Chain   int
+	Segment uint64
+	Reason  string
+}
+
+// brokenChains walks every chain of a trigram on its own, and returns those
+// that are corrupt, together with the keys of the entries reached by any
+// walk, which are therefore not orphaned.
+func (s *Server) brokenChains(ctx context.Context, get GetFunc, chains []searchToken) ([]brokenChain, []string, error) {
+	var broken []brokenChain
+	var reached []string
+	for i, tok := range chains {
+		err := s.walkChain(ctx, get, tok, func(iutok []byte, entry Entry) error {
+			if entry.Tag == nil {
+				return fmt.Errorf("%w: missing entry", ErrCorruptChain)
+			}
+			reached = append(reached, string(iutok))
+			return nil
+		})
+		if errors.Is(err, ErrCorruptChain) {
+			broken = append(broken, brokenChain{Chain: i, Segment: tok.Segment, Reason: err.Error()})
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+	return broken, reached, nil
+}
+
+// reservedKey reports whether a store key holds server metadata rather than a
+// chain entry.
+func reservedKey(key []byte) bool {
+	return bytes.Equal(key, backupKey) || bytes.Equal(key, epochKey) || isDeviceLogKey(key)
+}
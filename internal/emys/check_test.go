@@ -0,0 +1,277 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestCheck(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() *emys.CheckReport {
+		ctok, err := client.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveCheck(ctok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := client.OpenCheck(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	utoks, err := client.Update(
+		sse.Change[uint64]{FileID: 0, Diff: emys.Diff(nil, []byte("Hello"))},
+		sse.Change[uint64]{FileID: 69, Diff: emys.Diff(nil, []byte("Gopher"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if report := check(); !report.OK() || report.Trigrams != 7 {
+		t.Fatalf("unexpected faults in consistent index: %+v", report)
+	}
+
+	// The check compacted every chain, which later updates and searches must
+	// still be able to walk.
+	utoks, err = client.Update(sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("Hello"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		stok, err := client.Search("Hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult("Hello", res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 2 || ids[0] != 0 || ids[1] != 1 {
+			t.Errorf("search after check: got %v, want [0 1]", ids)
+		}
+	}
+
+	utoks, err = client.Update(
+		sse.Change[uint64]{FileID: 69, Diff: emys.Diff(nil, []byte("Gopher"))},
+		sse.Change[uint64]{FileID: 3, Diff: emys.Diff([]byte("abc"), nil)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := emys.NewClient([]byte("BLACK WIZARDRY, YELLOW SUBMARINE"), nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utoks, err = other.Update(sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("xyz"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+
+	report := check()
+	if report.Trigrams != 8 {
+		t.Errorf("got %d checked trigrams, want 8", report.Trigrams)
+	}
+	if len(report.Overflowed) != 4 {
+		t.Errorf("got %d overflowed counters, want 4: %+v", len(report.Overflowed), report.Overflowed)
+	}
+	for _, f := range report.Overflowed {
+		if f.FileID != 69 || f.Counter != 2 {
+			t.Errorf("unexpected overflowed counter: %+v", f)
+		}
+	}
+	want := emys.CounterFault{Trigram: "abc", FileID: 3, Counter: -1}
+	if len(report.Negative) != 1 || report.Negative[0] != want {
+		t.Errorf("got negative counters %+v, want [%+v]", report.Negative, want)
+	}
+	if len(report.Orphaned) != 1 {
+		t.Errorf("got %d orphaned entries, want 1", len(report.Orphaned))
+	}
+}
+
+func TestCheckMixedSigns(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files 3 and 5 share a block, where their counters end up with
+	// opposite signs, in both orders.
+	utoks, err := client.Update(
+		sse.Change[uint64]{FileID: 3, Diff: emys.Diff([]byte("abc"), []byte("xyz"))},
+		sse.Change[uint64]{FileID: 5, Diff: emys.Diff([]byte("xyz"), []byte("abc"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	ctok, err := client.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.ResolveCheck(ctok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.OpenCheck(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Overflowed) != 0 {
+		t.Errorf("unexpected overflowed counters: %+v", report.Overflowed)
+	}
+	want := []emys.CounterFault{
+		{Trigram: "abc", FileID: 3, Counter: -1},
+		{Trigram: "xyz", FileID: 5, Counter: -1},
+	}
+	if !slices.Equal(report.Negative, want) {
+		t.Errorf("got negative counters %+v, want %+v", report.Negative, want)
+	}
+}
+
+func TestCheckBrokenChains(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := emys.NewMemoryStore()
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(changes ...sse.Change[uint64]) {
+		utoks, err := client.Update(changes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest entries of the chains of abc and xyz are lost, while def
+	// only has a newer one.
+	update(
+		sse.Change[uint64]{FileID: 0, Diff: emys.Diff(nil, []byte("abc"))},
+		sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("xyz"))},
+	)
+	var lost [][]byte
+	store.Keys(func(key []byte) error {
+		if len(key) == 64 {
+			lost = append(lost, key)
+		}
+		return nil
+	})
+	update(
+		sse.Change[uint64]{FileID: 2, Diff: emys.Diff(nil, []byte("abc"))},
+		sse.Change[uint64]{FileID: 3, Diff: emys.Diff(nil, []byte("xyz"))},
+		sse.Change[uint64]{FileID: 4, Diff: emys.Diff(nil, []byte("def"))},
+	)
+	for _, key := range lost {
+		if err := store.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctok, err := client.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.ResolveCheck(ctok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.OpenCheck(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var broken []string
+	for _, f := range report.Broken {
+		if f.Device != "" || f.Segment != 0 {
+			t.Errorf("unexpected broken chain: %+v", f)
+		}
+		broken = append(broken, f.Trigram)
+	}
+	if want := []string{"abc", "xyz"}; !slices.Equal(broken, want) {
+		t.Errorf("got broken chains of %q, want %q", broken, want)
+	}
+	if report.Trigrams != 3 || len(report.Overflowed) != 0 || len(report.Negative) != 0 || len(report.Orphaned) != 0 {
+		t.Errorf("unexpected faults: %+v", report)
+	}
+}
+
+func TestCheckNarrowCounters(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 1,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Check(); !errors.Is(err, emys.ErrNarrowCounters) {
+		t.Errorf("check of one-bit counters: got %v, want ErrNarrowCounters", err)
+	}
+}
@@ -0,0 +1,93 @@
+package emys
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"interrato.dev/emys/internal/sse"
+)
+
+// Compact returns a token asking the server to merge the chains of the given
+// trigrams, in every segment, exactly as a search for them would. Like a
+// search, it covers at most MaxSearchTrigrams trigrams, and fails with the
+// same errors otherwise.
+func (c *Client) Compact(trigrams ...string) (sse.SearchToken, error) {
+	trigrams = slices.Compact(slices.Sorted(slices.Values(trigrams)))
+	for _, trigram := range trigrams {
+		if !c.known(trigram) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownTrigram, trigram)
+		}
+	}
+	if len(trigrams) > int(c.config.MaxSearchTrigrams) {
+		return nil, &QueryError{Err: ErrQueryTooLong, Trigrams: len(trigrams), MaxTrigrams: int(c.config.MaxSearchTrigrams)}
+	}
+	segs := c.config.segments()
+	stok := c.searchTokens(trigrams, segs)
+	if len(stok) > c.config.maxSearchChains() {
+		return nil, fmt.Errorf("%w: %d chains across devices, at most %d", ErrQueryTooLong, len(stok), c.config.maxSearchChains())
+	}
+	c.markCompacted(trigrams, segs)
+	return encodeSearchTokens(stok), nil
+}
+
+// CompactionCandidates returns up to n trigrams whose chains likely hold at
+// least minLength entries on the server, longest first. The length of a chain
+// is estimated from the updates since the client last had it compacted, so it
+// is only accurate if the tokens of Search, Check and Compact are resolved.
+func (c *Client) CompactionCandidates(n int, minLength int64) []string {
+	lengths := make(map[string]int64)
+	c.devices(func(_ string, chains map[string]clientState) {
+		for trigram, segs := range chains {
+			for _, chain := range segs {
+				lengths[trigram] = max(lengths[trigram], chain.UpdateCount-chain.CompactedAt+1)
+			}
+		}
+	})
+	candidates := slices.DeleteFunc(slices.Collect(maps.Keys(lengths)), func(trigram string) bool {
+		return lengths[trigram] < minLength
+	})
+	slices.SortFunc(candidates, func(a, b string) int {
+		return cmp.Or(cmp.Compare(lengths[b], lengths[a]), cmp.Compare(a, b))
+	})
+	return candidates[:min(n, len(candidates))]
+}
+
+func (c *Client) markCompacted(q []string, segs []segment) {
+	c.devices(func(_ string, chains map[string]clientState) {
+		for _, trigram := range q {
+			for _, seg := range segs {
+				chain, ok := chains[trigram][seg.Start]
+				if !ok {
+					continue
+				}
+				chain.CompactedAt = chain.UpdateCount
+				chains[trigram][seg.Start] = chain
+			}
+		}
+	})
+}
+
+// ResolveCompact merges the chains in a Compact token, like ResolveSearch
+// would, but returns nothing.
+func (s *Server) ResolveCompact(token sse.SearchToken) error {
+	return s.ResolveCompactContext(context.Background(), token)
+}
+
+func (s *Server) ResolveCompactContext(ctx context.Context, token sse.SearchToken) error {
+	s.epochMu.RLock()
+	defer s.epochMu.RUnlock()
+	stok, err := decodeSearchTokens(token, s.config.maxSearchTokenSize(), "compaction token")
+	if err != nil {
+		return err
+	}
+	if err := s.checkSearchChains(stok); err != nil {
+		return err
+	}
+	return s.transact(ctx, "compacted chains", func(get GetFunc) (*Batch, error) {
+		_, _, compaction, err := s.resolveChains(ctx, get, stok)
+		return compaction, err
+	})
+}
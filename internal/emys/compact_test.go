@@ -0,0 +1,190 @@
+package emys_test
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestCompact(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := emys.NewMemoryStore()
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := func() int {
+		n := 0
+		store.Keys(func([]byte) error { n++; return nil })
+		return n
+	}
+
+	// "abc" is updated four times, "bcd" three times, "xyz" once.
+	for i, text := range []string{"abcd", "abcd", "abcd", "abc", "xyz"} {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: uint64(i), Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := client.CompactionCandidates(10, 2); !slices.Equal(got, []string{"abc", "bcd"}) {
+		t.Errorf("CompactionCandidates(10, 2) = %v, want [abc bcd]", got)
+	}
+	if got := client.CompactionCandidates(1, 1); !slices.Equal(got, []string{"abc"}) {
+		t.Errorf("CompactionCandidates(1, 1) = %v, want [abc]", got)
+	}
+
+	if _, err := client.Compact("zzz"); !errors.Is(err, emys.ErrUnknownTrigram) {
+		t.Errorf("compaction of an unknown trigram: got %v, want ErrUnknownTrigram", err)
+	}
+	before := entries()
+	ctok, err := client.Compact(client.CompactionCandidates(10, 2)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveCompact(ctok); err != nil {
+		t.Fatal(err)
+	}
+	if after := entries(); after != before-5 {
+		t.Errorf("compaction left %d entries, want %d", after, before-5)
+	}
+	if got := client.CompactionCandidates(10, 2); len(got) != 0 {
+		t.Errorf("CompactionCandidates(10, 2) = %v after compaction", got)
+	}
+
+	stok, err := client.Search("abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := client.OpenResult("abcd", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []uint64{0, 1, 2, 3}) {
+		t.Errorf("got %v, want [0 1 2 3]", ids)
+	}
+
+	state, err := client.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.CompactionCandidates(10, 2); len(got) != 0 {
+		t.Errorf("CompactionCandidates(10, 2) = %v after reload", got)
+	}
+
+	// The 12 trigrams of the alphabet are more than a search covers.
+	utoks, err := client.Update(sse.Change[uint64]{FileID: 5, Diff: emys.Diff(nil, []byte("abcdefghijklmn"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	var queryErr *emys.QueryError
+	_, err = client.Compact(client.CompactionCandidates(20, 1)...)
+	if !errors.As(err, &queryErr) || !errors.Is(err, emys.ErrQueryTooLong) {
+		t.Errorf("compaction of too many trigrams: got %v, want a *QueryError for ErrQueryTooLong", err)
+	} else if queryErr.Trigrams != 13 || queryErr.MaxTrigrams != 10 {
+		t.Errorf("got %+v, want 13 trigrams, at most 10", queryErr)
+	}
+}
+
+// The sum of a compacted chain must be stored under its newest entry, where
+// the next walk starts, and not under its oldest one.
+func TestCompactionKeepsHead(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := emys.NewMemoryStore()
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := func() map[string]bool {
+		out := make(map[string]bool)
+		store.Keys(func(key []byte) error {
+			// Only chain entries are keyed by 64-byte internal update tokens.
+			if len(key) == 64 {
+				out[string(key)] = true
+			}
+			return nil
+		})
+		return out
+	}
+
+	// Every update adds the newest entry of each of the three chains.
+	var heads map[string]bool
+	for i := range 3 {
+		before := keys()
+		utoks, err := client.Update(sse.Change[uint64]{FileID: uint64(i), Diff: emys.Diff(nil, []byte("hello"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		heads = keys()
+		for key := range before {
+			delete(heads, key)
+		}
+	}
+	search := func() []uint64 {
+		stok, err := client.Search("hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult("hello", result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if ids := search(); !slices.Equal(ids, []uint64{0, 1, 2}) {
+		t.Fatalf("got %v, want [0 1 2]", ids)
+	}
+	if after := keys(); !maps.Equal(after, heads) {
+		t.Fatalf("compacted chains stored elsewhere than their newest entries")
+	}
+	if ids := search(); !slices.Equal(ids, []uint64{0, 1, 2}) {
+		t.Errorf("got %v after compaction, want [0 1 2]", ids)
+	}
+}
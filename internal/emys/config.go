@@ -1,37 +1,287 @@
 package emys
 
 import (
+	"bytes"
+	"cmp"
 	"fmt"
+	"math"
 	"math/bits"
+	"slices"
+	"strconv"
+
+	"github.com/zeebo/blake3"
+	"interrato.dev/emys/internal/ahe"
+	"interrato.dev/emys/internal/bitset"
 )
 
 type Config struct {
 	MaxFiles          uint64  // max is 2⁶⁰-1
 	MaxSearchTrigrams uint16  // max is 2¹⁶-1
 	SearchThreshold   float64 // (0,1]
+
+	// GrownFrom lists the previous values of MaxFiles, oldest first. Each
+	// growth step adds a segment of the index with chains of its own, so that
+	// chains built under a smaller capacity stay valid.
+	GrownFrom []uint64
+
+	// SegmentFiles, if not zero, further splits the index into segments of at
+	// most this many files. Updates then only carry the segments holding the
+	// changed files, and searches can target a subset of segments. In
+	// exchange, the server learns which segments each update touches and
+	// each search targets, that is, which groups of files change together and
+	// which ones are of interest. When zero, every update carries every
+	// segment and every search targets all of them.
+	SegmentFiles uint64
+
+	// CounterBits, if not zero, sets the width of each file counter, which
+	// otherwise is the minimum needed to count up to MaxSearchTrigrams.
+	CounterBits uint8 // max is 64
+
+	// DerivedSearchTokens makes the client derive the internal search token
+	// of each chain entry from its key, trigram and update count, instead of
+	// picking and storing a random one. The client state then boils down to
+	// update counts. Tokens repeat if the client state is rolled back and
+	// updated again, which links the entries of both branches.
+	DerivedSearchTokens bool
+
+	// Workers bounds the goroutines used to build update tokens, resolve
+	// chains and derive result keys. Zero or one means no parallelism. It does
+	// not affect tokens or results, and client and server may differ.
+	Workers int
 }
 
 func (c *Config) validate() error {
+	if c.MaxFiles == 0 {
+		return fmt.Errorf("maximum number of files must be positive")
+	}
 	if c.MaxFiles >= 1<<60 {
 		return fmt.Errorf("maximum number of files too big: %d", c.MaxFiles)
 	}
-	if 256%c.fileBitLen() != 0 {
+	if c.MaxSearchTrigrams == 0 {
 		return fmt.Errorf("invalid maximum number of search trigrams: %d", c.MaxSearchTrigrams)
 	}
+	if c.CounterBits != 0 && (c.CounterBits > 64 || int(c.CounterBits) < bits.Len16(c.MaxSearchTrigrams)) {
+		return fmt.Errorf("invalid counter width for %d search trigrams: %d", c.MaxSearchTrigrams, c.CounterBits)
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("invalid number of workers: %d", c.Workers)
+	}
 	if c.SearchThreshold <= 0 || c.SearchThreshold > 1 {
 		return fmt.Errorf("search threshold out of range")
 	}
+	prev := uint64(0)
+	segments := uint64(0)
+	for _, maxFiles := range append(slices.Clip(c.GrownFrom), c.MaxFiles) {
+		if maxFiles <= prev {
+			return fmt.Errorf("capacity history not strictly increasing: %v", c.GrownFrom)
+		}
+		if c.SegmentFiles == 0 {
+			segments++
+		} else {
+			segments += (maxFiles - prev + c.SegmentFiles - 1) / c.SegmentFiles
+		}
+		prev = maxFiles
+	}
+	if segments > maxSegments {
+		return fmt.Errorf("too many segments: %d", segments)
+	}
+	return nil
+}
+
+const (
+	// maxSegments bounds the segments of an index, whose list is built
+	// whenever a token is.
+	maxSegments = 1 << 20
+	// maxDevices bounds the devices sharing an index.
+	maxDevices = 256
+	// maxCheckTrigrams bounds the trigrams of a check token, and
+	// maxCheckChains the chains of a check or cut-over token, whatever the
+	// number of segments.
+	maxCheckTrigrams = 1 << 20
+	maxCheckChains   = 1 << 22
+
+	// maxEncodedChainSize bounds the encoding of a chain in a token, and
+	// maxEncodingOverhead that of the rest, such as gob type descriptors.
+	// Together they cap the size of tokens before they are decoded.
+	maxEncodedChainSize = 256
+	maxEncodingOverhead = 1 << 10
+	maxCheckTokenSize   = maxEncodingOverhead + maxCheckChains*maxEncodedChainSize
+	maxBackupTokenSize  = 1 << 30
+)
+
+// maxSearchChains is the most chains a search token can hold. The chains of
+// every device count, so a device writing to the same trigrams as others
+// leaves room for fewer trigrams in a query.
+func (c *Config) maxSearchChains() int {
+	return int(c.MaxSearchTrigrams) * len(c.segments())
+}
+
+func (c *Config) maxSearchTokenSize() int {
+	return maxEncodingOverhead + c.maxSearchChains()*maxEncodedChainSize
+}
+
+// maxUpdateTokenSize bounds an update token by the index of the largest
+// segment.
+func (c *Config) maxUpdateTokenSize() int {
+	var files, prev uint64
+	for _, end := range append(slices.Clip(c.GrownFrom), c.MaxFiles) {
+		files = max(files, end-prev)
+		prev = end
+	}
+	if c.SegmentFiles > 0 {
+		files = min(files, c.SegmentFiles)
+	}
+	return maxEncodingOverhead + ahe.BlockSize*int(c.indexBlocks(segment{Files: files}))
+}
+
+// Grow returns a copy of the config with capacity for maxFiles files.
+func (c *Config) Grow(maxFiles uint64) (*Config, error) {
+	if maxFiles <= c.MaxFiles {
+		return nil, fmt.Errorf("capacity can only grow: %d <= %d", maxFiles, c.MaxFiles)
+	}
+	grown := *c
+	grown.MaxFiles = maxFiles
+	grown.GrownFrom = append(slices.Clip(c.GrownFrom), c.MaxFiles)
+	if err := grown.validate(); err != nil {
+		return nil, err
+	}
+	return &grown, nil
+}
+
+const fingerprintSize = 16
+
+// Fingerprint returns a digest of every parameter that clients and servers
+// sharing an index must agree on, that is all of them but Workers and
+// DerivedSearchTokens, which a client may switch at any time. It is carried
+// by tokens and client states, so that a mismatch is reported as a
+// *ConfigMismatchError instead of going unnoticed.
+func (c *Config) Fingerprint() []byte {
+	grownFrom := make([]byte, 0, 8*len(c.GrownFrom))
+	for _, maxFiles := range c.GrownFrom {
+		grownFrom = append(grownFrom, le64(maxFiles)...)
+	}
+	sum := blake3.Sum256(canonicalize(
+		emysLabel, "config fingerprint",
+		strconv.FormatUint(c.MaxFiles, 10),
+		strconv.FormatUint(uint64(c.MaxSearchTrigrams), 10),
+		strconv.FormatUint(math.Float64bits(c.SearchThreshold), 16),
+		string(grownFrom),
+		strconv.FormatUint(c.SegmentFiles, 10),
+		strconv.FormatUint(uint64(c.CounterBits), 10),
+	))
+	return sum[:fingerprintSize]
+}
+
+// ConfigMismatchError reports a token, result or state that was produced
+// under a config other than the local one.
+type ConfigMismatchError struct {
+	Object string // such as "search token" or "client state"
+	Reason string
+}
+
+func (e *ConfigMismatchError) Error() string {
+	return fmt.Sprintf("%s produced under another config: %s", e.Object, e.Reason)
+}
+
+func (c *Config) checkFingerprint(object string, fingerprint []byte) error {
+	if !bytes.Equal(fingerprint, c.Fingerprint()) {
+		return &ConfigMismatchError{Object: object, Reason: fmt.Sprintf("fingerprint %x, want %x", fingerprint, c.Fingerprint())}
+	}
+	return nil
+}
+
+func (c *Config) checkIndexLength(object string, seg segment, index []byte) error {
+	if want := ahe.BlockSize * c.indexBlocks(seg); uint64(len(index)) != want {
+		return &ConfigMismatchError{Object: object, Reason: fmt.Sprintf("index of segment %d is %d bytes, want %d", seg.Start, len(index), want)}
+	}
 	return nil
 }
 
 func (c *Config) fileBitLen() uint64 {
+	if c.CounterBits != 0 {
+		return uint64(c.CounterBits)
+	}
 	return uint64(bits.Len16(c.MaxSearchTrigrams))
 }
 
-func (c *Config) indexBitLen() uint64 {
-	return c.MaxFiles * c.fileBitLen()
+// segment is a contiguous range of file identifiers whose counters are
+// encrypted in an index of their own. Segments are identified by their first
+// file identifier.
+type segment struct {
+	Start uint64
+	Files uint64
+}
+
+func (c *Config) segments() []segment {
+	var out []segment
+	start := uint64(0)
+	for _, end := range append(slices.Clip(c.GrownFrom), c.MaxFiles) {
+		for start < end {
+			files := end - start
+			if c.SegmentFiles > 0 {
+				files = min(files, c.SegmentFiles)
+			}
+			out = append(out, segment{Start: start, Files: files})
+			start += files
+		}
+	}
+	return out
+}
+
+func (c *Config) segment(start uint64) (segment, bool) {
+	segs := c.segments()
+	i, ok := slices.BinarySearchFunc(segs, start, func(seg segment, start uint64) int {
+		return cmp.Compare(seg.Start, start)
+	})
+	if !ok {
+		return segment{}, false
+	}
+	return segs[i], true
+}
+
+// touchedSegments returns the segments an update of the given files must
+// carry, in order.
+func (c *Config) touchedSegments(segs []segment, ids []uint64) []segment {
+	if c.SegmentFiles == 0 {
+		return segs
+	}
+	touched := make([]bool, len(segs))
+	for _, id := range ids {
+		i, _ := slices.BinarySearchFunc(segs, id, func(seg segment, id uint64) int {
+			if seg.Start+seg.Files <= id {
+				return -1
+			}
+			if seg.Start > id {
+				return 1
+			}
+			return 0
+		})
+		touched[i] = true
+	}
+	var out []segment
+	for i, seg := range segs {
+		if touched[i] {
+			out = append(out, seg)
+		}
+	}
+	return out
+}
+
+// targetedSegments returns the segments overlapping the files of a range.
+func (c *Config) targetedSegments(r *FileRange) []segment {
+	segs := c.segments()
+	if r == nil {
+		return segs
+	}
+	return slices.DeleteFunc(segs, func(seg segment) bool {
+		return seg.Start+seg.Files <= r.From || seg.Start >= r.To
+	})
+}
+
+func (c *Config) layout(seg segment) bitset.Layout {
+	return bitset.Layout{Counters: seg.Files, Width: c.fileBitLen()}
 }
 
-func (c *Config) indexBlocks() uint64 {
-	return (c.indexBitLen() + 255) / 256
+func (c *Config) indexBlocks(seg segment) uint64 {
+	return c.layout(seg).Blocks()
 }
@@ -0,0 +1,79 @@
+package emys_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestConfigMismatch(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	same := *config
+	same.Workers = 4
+	same.DerivedSearchTokens = true
+	if !bytes.Equal(config.Fingerprint(), same.Fingerprint()) {
+		t.Error("fingerprint depends on Workers or DerivedSearchTokens")
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utoks, err := client.Update(sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("hello"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stok, err := client.Search("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := client.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mutate := range map[string]func(*emys.Config){
+		"MaxFiles":          func(c *emys.Config) { c.MaxFiles++ },
+		"MaxSearchTrigrams": func(c *emys.Config) { c.MaxSearchTrigrams++ },
+		"SearchThreshold":   func(c *emys.Config) { c.SearchThreshold = 0.5 },
+		"SegmentFiles":      func(c *emys.Config) { c.SegmentFiles = 10 },
+	} {
+		other := *config
+		mutate(&other)
+		server, err := emys.NewServer(&other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mismatch *emys.ConfigMismatchError
+		if err := server.ResolveUpdates(utoks...); !errors.As(err, &mismatch) {
+			t.Errorf("%s: update error = %v, want ConfigMismatchError", name, err)
+		}
+		if _, err := server.ResolveSearch(stok); !errors.As(err, &mismatch) {
+			t.Errorf("%s: search error = %v, want ConfigMismatchError", name, err)
+		}
+		otherClient, err := emys.NewClient(key, nonce, &other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := otherClient.LoadState(state); !errors.As(err, &mismatch) {
+			t.Errorf("%s: load state error = %v, want ConfigMismatchError", name, err)
+		}
+	}
+
+	server, err := emys.NewServer(&same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Errorf("update with compatible config: %v", err)
+	}
+}
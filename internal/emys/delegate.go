@@ -0,0 +1,241 @@
+package emys
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"slices"
+
+	"interrato.dev/emys/internal/ahe"
+	"interrato.dev/emys/internal/sse"
+)
+
+type delegation struct {
+	Config Config
+	Epoch  uint64
+	Chains map[string][]delegatedChain
+}
+
+type delegatedChain struct {
+	Segment             uint64
+	UpdateCount         int64
+	InternalSearchToken []byte
+	UpdateKey           []byte
+	// EncryptionKeys holds the encryption key seed of every entry, by update
+	// count.
+	EncryptionKeys [][]byte
+}
+
+// DelegateSearch returns a capability that lets another party search the
+// index with NewDelegatedSearcher. It holds the keys to find and decrypt the
+// chain entries written so far by every known device, but neither the master
+// key nor any authentication or integrity key, so its holder can't verify the
+// results it gets from the server.
+//
+// The capability grants write access to the chains it covers, though. Its
+// update keys and internal search tokens are what the server walks chains
+// with, and they are also enough to build update tokens that ResolveUpdates
+// accepts, which can replace or extend the entries of those chains. Such
+// entries can't carry a valid tag, so searches of the client fail with
+// ErrInvalidTag rather than return wrong files, but the chains stay damaged
+// until the index is rebuilt with Rotate, which also revokes the capability.
+// Only delegate to parties trusted with the integrity of the index.
+//
+// The capability holds the encryption key seed of every entry of every chain,
+// since a compacted chain is encrypted under all of them, so its size grows
+// with the number of updates written so far, and compaction does not shrink
+// it.
+//
+// The capability does not follow later updates and must be issued again to
+// cover them. Once the client compacts a chain beyond the head the capability
+// knows of, that chain no longer matches for its holder. Entries covered by a
+// capability stay readable to its holder until the index is re-keyed with
+// Rotate.
+func (c *Client) DelegateSearch() ([]byte, error) {
+	d := delegation{
+		Config: *c.config,
+		Epoch:  c.epoch,
+		Chains: make(map[string][]delegatedChain),
+	}
+	for _, trigram := range c.trigrams() {
+		for _, seg := range c.config.segments() {
+			c.devices(func(device string, chains map[string]clientState) {
+				chain, ok := chains[trigram][seg.Start]
+				if !ok {
+					return
+				}
+				keys := make([][]byte, chain.UpdateCount+1)
+				for count := range keys {
+					keys[count] = c.chainKey(encryptionKeyLabel, device, trigram, seg.Start, fmt.Sprintf("%d", count))
+				}
+				d.Chains[trigram] = append(d.Chains[trigram], delegatedChain{
+					Segment:             seg.Start,
+					UpdateCount:         chain.UpdateCount,
+					InternalSearchToken: c.internalSearchToken(device, trigram, seg.Start, chain),
+					UpdateKey:           c.chainKey(updateKeyLabel, device, trigram, seg.Start),
+					EncryptionKeys:      keys,
+				})
+			})
+		}
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(d); err != nil {
+		return nil, fmt.Errorf("failed to encode delegation: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DelegatedSearcher searches the index of a client on behalf of a capability
+// returned by Client.DelegateSearch. Its results are confidential, but not
+// authenticated: a malicious server can make it accept wrong ones.
+type DelegatedSearcher struct {
+	config *Config
+	epoch  uint64
+	chains map[string][]delegatedChain
+}
+
+var _ sse.ContextSearcher[uint64] = &DelegatedSearcher{}
+
+func NewDelegatedSearcher(capability []byte) (*DelegatedSearcher, error) {
+	var d delegation
+	dec := gob.NewDecoder(bytes.NewBuffer(capability))
+	if err := dec.Decode(&d); err != nil {
+		return nil, fmt.Errorf("failed to decode delegation: %w", err)
+	}
+	if err := d.Config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	for trigram, chains := range d.Chains {
+		for _, chain := range chains {
+			if _, ok := d.Config.segment(chain.Segment); !ok {
+				return nil, fmt.Errorf("unknown segment: %d", chain.Segment)
+			}
+			if chain.UpdateCount < 0 || int64(len(chain.EncryptionKeys)) != chain.UpdateCount+1 {
+				return nil, fmt.Errorf("invalid chain of trigram %q", trigram)
+			}
+		}
+	}
+	return &DelegatedSearcher{config: &d.Config, epoch: d.Epoch, chains: d.Chains}, nil
+}
+
+func (s *DelegatedSearcher) known(trigram string) bool {
+	return len(s.chains[trigram]) > 0
+}
+
+// segmentChains returns the chains of the trigrams in the segment.
+func (s *DelegatedSearcher) segmentChains(q []string, seg uint64) []delegatedChain {
+	var chains []delegatedChain
+	for _, trigram := range q {
+		for _, chain := range s.chains[trigram] {
+			if chain.Segment == seg {
+				chains = append(chains, chain)
+			}
+		}
+	}
+	return chains
+}
+
+func (s *DelegatedSearcher) segmentTrigrams(q []string, seg uint64) []string {
+	return slices.DeleteFunc(slices.Clone(q), func(trigram string) bool {
+		return len(s.segmentChains([]string{trigram}, seg)) == 0
+	})
+}
+
+func (s *DelegatedSearcher) Search(query sse.Query) (sse.SearchToken, error) {
+	return s.SearchContext(context.Background(), query)
+}
+
+// SearchContext builds the same token as Search. A delegated searcher has no
+// state to protect, so ctx is only checked once.
+func (s *DelegatedSearcher) SearchContext(ctx context.Context, query sse.Query) (sse.SearchToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	searchQuery, err := s.config.parseQuery(query, s.known)
+	if err != nil {
+		return nil, err
+	}
+	q := searchQuery.precomputedTrigrams
+	if len(q) == 0 {
+		return nil, nil
+	}
+	fingerprint := s.config.Fingerprint()
+	var stok []searchToken
+	for _, trigram := range q {
+		for _, seg := range s.config.targetedSegments(searchQuery.Range) {
+			for _, chain := range s.segmentChains([]string{trigram}, seg.Start) {
+				stok = append(stok, searchToken{
+					Config:              fingerprint,
+					Epoch:               s.epoch,
+					Segment:             chain.Segment,
+					UpdateCount:         chain.UpdateCount,
+					InternalSearchToken: chain.InternalSearchToken,
+					UpdateKey:           chain.UpdateKey,
+				})
+			}
+		}
+	}
+	return encodeSearchTokens(stok), nil
+}
+
+func (s *DelegatedSearcher) OpenResult(query sse.Query, result sse.SearchResult) ([]uint64, error) {
+	return s.OpenResultContext(context.Background(), query, result)
+}
+
+func (s *DelegatedSearcher) OpenResultContext(ctx context.Context, query sse.Query, result sse.SearchResult) ([]uint64, error) {
+	searchQuery, err := s.config.parseQuery(query, s.known)
+	if err != nil {
+		return nil, err
+	}
+	q := searchQuery.precomputedTrigrams
+	if len(q) == 0 {
+		return nil, nil
+	}
+	res, err := decodeSearchResult(result)
+	if err != nil {
+		return nil, err
+	}
+	segs := s.config.targetedSegments(searchQuery.Range)
+	want := 0
+	for _, seg := range segs {
+		if len(s.segmentChains(q, seg.Start)) > 0 {
+			want++
+		}
+	}
+	if len(res.Segments) != want {
+		return nil, fmt.Errorf("%w: covers %d segments, want %d", ErrMalformedResult, len(res.Segments), want)
+	}
+	indexes := make(map[uint64][]byte, len(res.Segments))
+	for _, segRes := range res.Segments {
+		chains := s.segmentChains(q, segRes.Segment)
+		if len(chains) == 0 || !slices.ContainsFunc(segs, func(seg segment) bool { return seg.Start == segRes.Segment }) {
+			return nil, fmt.Errorf("%w: unexpected segment %d", ErrMalformedResult, segRes.Segment)
+		}
+		if _, ok := indexes[segRes.Segment]; ok {
+			return nil, fmt.Errorf("%w: duplicate segment %d", ErrMalformedResult, segRes.Segment)
+		}
+		seg, _ := s.config.segment(segRes.Segment)
+		index := segRes.EncryptedIndex
+		if err := s.config.checkIndexLength("search result", seg, index); err != nil {
+			return nil, &SegmentError{Segment: seg.Start, Trigrams: s.segmentTrigrams(q, seg.Start), Err: err}
+		}
+		for _, chain := range chains {
+			for _, key := range chain.EncryptionKeys {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				ks, err := ahe.NewKeyStream(key)
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+				}
+				if err := ks.Sub(index); err != nil {
+					return nil, fmt.Errorf("failed to decrypt index: %w", err)
+				}
+			}
+		}
+		indexes[seg.Start] = index
+	}
+	return s.config.matches(searchQuery, segs, indexes)
+}
@@ -0,0 +1,90 @@
+package emys_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestDelegateSearch(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+		SegmentFiles:      32,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(id uint64, text string) {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(searcher sse.Searcher[uint64], query sse.Query) []uint64 {
+		stok, err := searcher.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := searcher.OpenResult(query, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	delegate := func() *emys.DelegatedSearcher {
+		capability, err := client.DelegateSearch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(capability, key) {
+			t.Fatal("capability holds the master key")
+		}
+		auditor, err := emys.NewDelegatedSearcher(capability)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return auditor
+	}
+
+	update(1, "hello world")
+	update(40, "hello there")
+	update(41, "goodbye world")
+	auditor := delegate()
+	for _, query := range []sse.Query{"hello", "world", &emys.Query{Text: "hello", Range: &emys.FileRange{From: 32, To: 64}}} {
+		want := search(client, query)
+		if got := search(auditor, query); !slices.Equal(got, want) {
+			t.Errorf("delegated search for %v = %v, want %v", query, got, want)
+		}
+	}
+
+	// Later updates are only visible to a new capability.
+	update(2, "hello again")
+	if got := search(auditor, "hello"); !slices.Equal(got, []uint64{1, 40}) {
+		t.Errorf("stale delegated search = %v, want [1 40]", got)
+	}
+	if got := search(delegate(), "hello"); !slices.Equal(got, []uint64{1, 2, 40}) {
+		t.Errorf("renewed delegated search = %v, want [1 2 40]", got)
+	}
+	if stok, err := auditor.Search("zzzz"); err != nil || stok != nil {
+		t.Errorf("search for unknown trigrams = %v, %v, want nil token", stok, err)
+	}
+}
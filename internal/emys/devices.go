@@ -0,0 +1,248 @@
+package emys
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/zeebo/blake3"
+)
+
+// deviceState holds the chains written by a device, together with a summary
+// of the Update calls that wrote them.
+type deviceState struct {
+	Log    updateLog
+	Chains map[string]clientState
+}
+
+// updateLog counts the updates of a device and chains their random
+// identifiers into a running hash. The server keeps the hash of the last
+// update of every device and refuses updates that do not extend it, so two
+// states of a device that diverged cannot both reach the index.
+type updateLog struct {
+	Count uint64
+	Hash  []byte
+}
+
+const (
+	updateIDSize   = 8
+	deviceLogLabel = "device log"
+)
+
+func (l updateLog) append(updateID []byte) updateLog {
+	hash := blake3.Sum256(append(slices.Clone(l.Hash), updateID...))
+	return updateLog{Count: l.Count + 1, Hash: hash[:]}
+}
+
+// covers reports whether a may hold every update of b: at least as many of
+// them, the same ones if as many, and chains at least as long. It can miss a
+// fork where a has more updates on every chain, but then the updates of one
+// of the two states were refused by the server, which reports the fork.
+func (a deviceState) covers(b deviceState) bool {
+	if a.Log.Count < b.Log.Count || a.Log.Count == b.Log.Count && !bytes.Equal(a.Log.Hash, b.Log.Hash) {
+		return false
+	}
+	for trigram, chains := range b.Chains {
+		for seg, chain := range chains {
+			ours, ok := a.Chains[trigram][seg]
+			if !ok || ours.UpdateCount < chain.UpdateCount {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deviceID names the device of the client to the server, without revealing
+// its identifier.
+func (c *Client) deviceID() []byte {
+	return deriveKey(c.key, string(c.userNonce), deviceLogLabel, c.device)
+}
+
+// deviceLogKey is where the server keeps the log hash of a device. It is
+// shorter than an internal update token, so it never names a chain entry.
+func deviceLogKey(id []byte) []byte {
+	return append([]byte("device log "), id...)
+}
+
+// isDeviceLogKey reports whether key is one of deviceLogKey.
+func isDeviceLogKey(key []byte) bool {
+	return len(key) == len("device log ")+32 && bytes.HasPrefix(key, []byte("device log "))
+}
+
+// extendDeviceLogs adds to b the log hash of every device with an update in
+// utoks, after checking that the update extends the last one of the device.
+// The tokens of an update already applied are accepted again, since they can
+// be resolved over several calls.
+func extendDeviceLogs(get GetFunc, utoks []updateToken, b *Batch) error {
+	heads := make(map[string][]byte)
+	for _, utok := range utoks {
+		key := deviceLogKey(utok.Device)
+		head, ok := heads[string(key)]
+		if !ok {
+			entry, _, err := get(key)
+			if err != nil {
+				return fmt.Errorf("failed to read device log: %w", err)
+			}
+			head = entry.EncryptedIndex
+		}
+		switch {
+		case bytes.Equal(head, utok.NextLog):
+		case bytes.Equal(head, utok.Log):
+			head = utok.NextLog
+			b.Put(key, Entry{EncryptedIndex: head})
+		default:
+			return fmt.Errorf("%w: update does not follow the last one of its device", ErrDeviceForked)
+		}
+		heads[string(key)] = head
+	}
+	return nil
+}
+
+// SetDevice makes the client write its chains in a namespace of their own, so
+// that devices sharing a key and user nonce can update the index concurrently
+// and exchange their chains through Merge. Every device needs a distinct
+// identifier, and the empty one is used by clients that never call SetDevice.
+// It must be called before the first update.
+func (c *Client) SetDevice(id string) error {
+	if c.log.Count != 0 || len(c.state) != 0 {
+		return fmt.Errorf("device %q already has updates", c.device)
+	}
+	if _, ok := c.peers[id]; ok {
+		return fmt.Errorf("device %q already known", id)
+	}
+	c.device = id
+	return nil
+}
+
+func (c *Client) Device() string {
+	return c.device
+}
+
+// devices calls fn with the chains of every known device, this one included,
+// in order of identifier.
+func (c *Client) devices(fn func(device string, chains map[string]clientState)) {
+	ids := slices.Sorted(maps.Keys(c.peers))
+	ids, _ = insertSorted(ids, c.device)
+	for _, id := range ids {
+		if id == c.device {
+			fn(id, c.state)
+		} else {
+			fn(id, c.peers[id].Chains)
+		}
+	}
+}
+
+func insertSorted(s []string, v string) ([]string, bool) {
+	i, found := slices.BinarySearch(s, v)
+	if found {
+		return s, false
+	}
+	return slices.Insert(s, i, v), true
+}
+
+// known reports whether any device has a chain for the trigram.
+func (c *Client) known(trigram string) bool {
+	found := false
+	c.devices(func(_ string, chains map[string]clientState) {
+		_, ok := chains[trigram]
+		found = found || ok
+	})
+	return found
+}
+
+// hasChain reports whether any device has a chain for the trigram in the
+// segment.
+func (c *Client) hasChain(trigram string, seg uint64) bool {
+	found := false
+	c.devices(func(_ string, chains map[string]clientState) {
+		_, ok := chains[trigram][seg]
+		found = found || ok
+	})
+	return found
+}
+
+// trigrams returns every trigram known to any device, sorted.
+func (c *Client) trigrams() []string {
+	var q []string
+	c.devices(func(_ string, chains map[string]clientState) {
+		for trigram := range chains {
+			q, _ = insertSorted(q, trigram)
+		}
+	})
+	return q
+}
+
+// chainRef is the chain of a trigram written by a device in a segment.
+type chainRef struct {
+	device  string
+	trigram string
+	count   int64
+}
+
+// segmentChains returns the chains of the trigrams in the segment, device by
+// device.
+func (c *Client) segmentChains(q []string, seg uint64) []chainRef {
+	var refs []chainRef
+	for _, trigram := range q {
+		c.devices(func(device string, chains map[string]clientState) {
+			if chain, ok := chains[trigram][seg]; ok {
+				refs = append(refs, chainRef{device, trigram, chain.UpdateCount})
+			}
+		})
+	}
+	return refs
+}
+
+// segmentTrigrams returns the trigrams of q with a chain in the segment.
+func (c *Client) segmentTrigrams(q []string, seg uint64) []string {
+	return slices.DeleteFunc(slices.Clone(q), func(trigram string) bool {
+		return !c.hasChain(trigram, seg)
+	})
+}
+
+// Merge adds to the client state the chains of the devices in a backup
+// returned by Server.Backup, keeping for each device whichever state holds
+// the most updates. This device is also brought forward if the backup holds
+// updates of its own that were lost locally, for example to a state rollback.
+// If the states of a device diverged, Merge returns ErrDeviceForked and
+// leaves the client state untouched.
+//
+// Merging a backup also makes it the base of the next Backup, so a device
+// whose backup was refused as stale can merge the latest one and try again.
+func (c *Client) Merge(backup []byte) error {
+	state, err := c.openBackup(backup)
+	if err != nil {
+		return err
+	}
+	if state.Epoch != c.epoch {
+		return fmt.Errorf("%w: backup of epoch %d, client at epoch %d", ErrEpochMismatch, state.Epoch, c.epoch)
+	}
+	local := maps.Clone(c.peers)
+	if local == nil {
+		local = make(map[string]deviceState)
+	}
+	local[c.device] = deviceState{Log: c.log, Chains: c.state}
+	for _, id := range slices.Sorted(maps.Keys(state.Devices)) {
+		theirs := state.Devices[id]
+		ours, ok := local[id]
+		switch {
+		case ok && ours.covers(theirs):
+		case !ok || theirs.covers(ours):
+			local[id] = theirs
+		default:
+			return fmt.Errorf("%w: %q", ErrDeviceForked, id)
+		}
+	}
+	if len(local) > maxDevices {
+		return fmt.Errorf("too many devices: %d", len(local))
+	}
+	own := local[c.device]
+	delete(local, c.device)
+	c.state = own.Chains
+	c.log = own.Log
+	c.peers = local
+	c.backupVersion = state.Version
+	return nil
+}
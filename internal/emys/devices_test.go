@@ -0,0 +1,199 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestDevices(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDevice := func(id string) *emys.Client {
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetDevice(id); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	update := func(client *emys.Client, id uint64, text string) {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// sync backs up the client state, merging the latest backup first if
+	// another device got there before.
+	sync := func(client *emys.Client) error {
+		for {
+			token, err := client.Backup()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := server.ResolveBackup(token)
+			if errors.Is(err, emys.ErrStaleBackup) {
+				backup, err := server.Backup()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := client.Merge(backup); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return client.OpenBackupResult(result)
+		}
+	}
+	search := func(client *emys.Client, text string) []uint64 {
+		q := &emys.Query{Text: text}
+		stok, err := client.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(q, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	laptop := newDevice("laptop")
+	phone := newDevice("phone")
+	if err := sync(laptop); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both devices update the same trigrams without knowing of each other.
+	update(laptop, 0, "hello world")
+	update(phone, 1, "hello there")
+	update(phone, 2, "say hello")
+	if got := search(laptop, "hello"); !slices.Equal(got, []uint64{0}) {
+		t.Errorf("laptop search before sync = %v, want [0]", got)
+	}
+	for _, client := range []*emys.Client{laptop, phone, laptop} {
+		if err := sync(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, client := range map[string]*emys.Client{"laptop": laptop, "phone": phone} {
+		if got := search(client, "hello"); !slices.Equal(got, []uint64{0, 1, 2}) {
+			t.Errorf("%s search after sync = %v, want [0 1 2]", name, got)
+		}
+	}
+
+	// A file inserted by one device can be removed by another.
+	utoks, err := laptop.Update(sse.Change[uint64]{FileID: 1, Diff: emys.Diff([]byte("hello there"), nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(laptop); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(phone); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(phone, "hello"); !slices.Equal(got, []uint64{0, 2}) {
+		t.Errorf("phone search after removal = %v, want [0 2]", got)
+	}
+
+	// The phone state is copied to a tablet, and both then write as the
+	// phone. The server refuses whichever updates come second, even once the
+	// tablet is ahead of the phone on every chain.
+	state, err := phone.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tablet, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tablet.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	update(phone, 3, "hello again")
+	for _, id := range []uint64{4, 5} {
+		utoks, err := tablet.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte("hello again"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); !errors.Is(err, emys.ErrDeviceForked) {
+			t.Errorf("update of forked device error = %v, want ErrDeviceForked", err)
+		}
+	}
+	if err := sync(phone); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(laptop, "hello"); !slices.Equal(got, []uint64{0, 2}) {
+		t.Errorf("laptop search before sync with the fork = %v, want [0 2]", got)
+	}
+	if err := sync(laptop); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(laptop, "hello"); !slices.Equal(got, []uint64{0, 2, 3}) {
+		t.Errorf("laptop search after sync with the fork = %v, want [0 2 3]", got)
+	}
+
+	// Two copies of a state as many updates apart are told apart by Merge.
+	fork, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fork.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fork.Update(sse.Change[uint64]{FileID: 6, Diff: emys.Diff(nil, []byte("xyz"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(fork); !errors.Is(err, emys.ErrDeviceForked) {
+		t.Errorf("sync of forked device error = %v, want ErrDeviceForked", err)
+	}
+
+	// Clients that never set a device are refused in the same way.
+	var single [2]*emys.Client
+	for i := range single {
+		single[i], err = emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(single[0], 7, "solo")
+	utoks, err = single[1].Update(sse.Change[uint64]{FileID: 8, Diff: emys.Diff(nil, []byte("solo"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); !errors.Is(err, emys.ErrDeviceForked) {
+		t.Errorf("update of second unnamed client error = %v, want ErrDeviceForked", err)
+	}
+
+	if err := laptop.SetDevice("desktop"); err == nil {
+		t.Error("device of a client with updates was changed")
+	}
+}
@@ -7,13 +7,16 @@ import (
 	"maps"
 	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
 func Diff(old []byte, new []byte) []byte {
+	return diffTrigrams(trigrams(string(old)), trigrams(string(new)))
+}
+
+func diffTrigrams(a, b []string) []byte {
 	var removed []string
 	var inserted []string
-	a := trigrams(string(old))
-	b := trigrams(string(new))
 	i, j := 0, 0
 	for i < len(a) && j < len(b) {
 		if a[i] == b[j] {
@@ -48,10 +51,13 @@ func ParseDiff(diff []byte) (removed []string, inserted []string, err error) {
 		}
 		trigram := make([]rune, 3)
 		for i := range 3 {
-			t, _, err := r.ReadRune()
+			t, size, err := r.ReadRune()
 			if err == io.EOF {
 				return nil, nil, fmt.Errorf("bad diff format")
 			}
+			if t == utf8.RuneError && size == 1 {
+				return nil, nil, fmt.Errorf("invalid UTF-8 in diff")
+			}
 			trigram[i] = t
 		}
 		switch b {
@@ -66,13 +72,12 @@ func ParseDiff(diff []byte) (removed []string, inserted []string, err error) {
 	return
 }
 
+// trigrams returns the distinct trigrams of a text, sorted, and none if the
+// text is shorter than three runes.
 func trigrams(text string) []string {
-	if len(text) == 0 {
-		return nil
-	}
 	runes := []rune(text)
 	if len(runes) < 3 {
-		panic("emys: cannot work with less than 3 runes")
+		return nil
 	}
 	out := make(map[string]struct{}, len(runes)-2)
 	for i := range len(runes) - 2 {
@@ -0,0 +1,219 @@
+package emys
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"slices"
+
+	"interrato.dev/emys/internal/sse"
+)
+
+// Documents maps arbitrary document identifiers to the file identifiers
+// (index slots) of a Client. Slots are assigned on first update, the lowest
+// free one first, and become free again once the document is deleted.
+type Documents[T comparable] struct {
+	client *Client
+	slots  map[T]uint64
+	ids    map[uint64]T
+	free   []uint64
+	next   uint64
+}
+
+func NewDocuments[T comparable](client *Client) *Documents[T] {
+	return &Documents[T]{
+		client: client,
+		slots:  make(map[T]uint64),
+		ids:    make(map[uint64]T),
+	}
+}
+
+var (
+	_ sse.ContextSearcher[string] = &Documents[string]{}
+	_ sse.ContextUpdater[string]  = &Documents[string]{}
+)
+
+// documentsState holds FileCache as sealed by Client.FileCache, or nil if the
+// file cache is disabled.
+type documentsState[T comparable] struct {
+	Client    clientDump
+	FileCache []byte
+	Slots     map[T]uint64
+	Next      uint64
+}
+
+// State returns the client state together with the file cache, if enabled,
+// and the document mapping, encrypted like Client.State.
+func (d *Documents[T]) State() ([]byte, error) {
+	var files []byte
+	if d.client.files != nil {
+		var err error
+		if files, err = d.client.FileCache(); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	state := documentsState[T]{
+		Client:    d.client.dump(),
+		FileCache: files,
+		Slots:     d.slots,
+		Next:      d.next,
+	}
+	if err := enc.Encode(state); err != nil {
+		return nil, fmt.Errorf("failed to encode documents state: %w", err)
+	}
+	return d.client.sealState(clientStateKeyLabel, "documents state dump", buf.Bytes())
+}
+
+func (d *Documents[T]) LoadState(state []byte) error {
+	plaintext, err := d.client.openState(clientStateKeyLabel, "documents state dump", "documents state", state)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt documents state: %w", err)
+	}
+	var s documentsState[T]
+	dec := gob.NewDecoder(bytes.NewBuffer(plaintext))
+	if err := dec.Decode(&s); err != nil {
+		return fmt.Errorf("failed to decode documents state: %w", err)
+	}
+	ids := make(map[uint64]T, len(s.Slots))
+	for id, slot := range s.Slots {
+		if slot >= s.Next {
+			return fmt.Errorf("slot %d beyond allocated range", slot)
+		}
+		if _, ok := ids[slot]; ok {
+			return fmt.Errorf("slot %d assigned twice", slot)
+		}
+		ids[slot] = id
+	}
+	var free []uint64
+	for slot := range s.Next {
+		if _, ok := ids[slot]; !ok {
+			free = append(free, slot)
+		}
+	}
+	if s.Slots == nil {
+		s.Slots = make(map[T]uint64)
+	}
+	if s.FileCache != nil {
+		if err := d.client.LoadFileCache(s.FileCache); err != nil {
+			return err
+		}
+	}
+	d.client.restore(s.Client)
+	d.slots = s.Slots
+	d.ids = ids
+	d.free = free
+	d.next = s.Next
+	return nil
+}
+
+func (d *Documents[T]) Slot(id T) (uint64, bool) {
+	slot, ok := d.slots[id]
+	return slot, ok
+}
+
+func (d *Documents[T]) Search(query sse.Query) (sse.SearchToken, error) {
+	return d.client.Search(query)
+}
+
+func (d *Documents[T]) SearchContext(ctx context.Context, query sse.Query) (sse.SearchToken, error) {
+	return d.client.SearchContext(ctx, query)
+}
+
+func (d *Documents[T]) OpenResult(query sse.Query, result sse.SearchResult) ([]T, error) {
+	return d.OpenResultContext(context.Background(), query, result)
+}
+
+func (d *Documents[T]) OpenResultContext(ctx context.Context, query sse.Query, result sse.SearchResult) ([]T, error) {
+	slots, err := d.client.OpenResultContext(ctx, query, result)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]T, 0, len(slots))
+	for _, slot := range slots {
+		if id, ok := d.ids[slot]; ok {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+func (d *Documents[T]) Update(changes ...sse.Change[T]) ([]sse.UpdateToken, error) {
+	return d.UpdateContext(context.Background(), changes...)
+}
+
+// UpdateContext is like Update, but gives up once ctx is done. Slots assigned
+// along the way are taken back, leaving the free list as it was.
+func (d *Documents[T]) UpdateContext(ctx context.Context, changes ...sse.Change[T]) ([]sse.UpdateToken, error) {
+	var assigned []T
+	free, next := slices.Clone(d.free), d.next
+	rollback := func() {
+		for _, id := range assigned {
+			delete(d.ids, d.slots[id])
+			delete(d.slots, id)
+		}
+		d.free, d.next = free, next
+	}
+	slotChanges := make([]sse.Change[uint64], len(changes))
+	for i, change := range changes {
+		slot, ok := d.slots[change.FileID]
+		if !ok {
+			var err error
+			slot, err = d.assign(change.FileID)
+			if err != nil {
+				rollback()
+				return nil, err
+			}
+			assigned = append(assigned, change.FileID)
+		}
+		slotChanges[i] = sse.Change[uint64]{FileID: slot, Diff: change.Diff}
+	}
+	utoks, err := d.client.UpdateContext(ctx, slotChanges...)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	return utoks, nil
+}
+
+// Delete removes every trigram of a document from the index and frees its
+// slot. It requires the client file cache to be enabled.
+func (d *Documents[T]) Delete(id T) ([]sse.UpdateToken, error) {
+	slot, ok := d.slots[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownDocument, id)
+	}
+	utoks, err := d.client.DeleteFile(slot)
+	if err != nil {
+		return nil, err
+	}
+	d.release(id)
+	return utoks, nil
+}
+
+func (d *Documents[T]) assign(id T) (uint64, error) {
+	var slot uint64
+	if len(d.free) > 0 {
+		slot = d.free[0]
+		d.free = d.free[1:]
+	} else {
+		if d.next >= d.client.config.MaxFiles {
+			return 0, fmt.Errorf("no free slot for document: %v", id)
+		}
+		slot = d.next
+		d.next++
+	}
+	d.slots[id] = slot
+	d.ids[slot] = id
+	return slot, nil
+}
+
+func (d *Documents[T]) release(id T) {
+	slot := d.slots[id]
+	delete(d.slots, id)
+	delete(d.ids, slot)
+	i, _ := slices.BinarySearch(d.free, slot)
+	d.free = slices.Insert(d.free, i, slot)
+}
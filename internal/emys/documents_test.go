@@ -0,0 +1,157 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestDocuments(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          2,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableFileCache()
+	docs := emys.NewDocuments[string](client)
+
+	search := func(text string) []string {
+		stok, err := docs.Search(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := docs.OpenResult(text, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	resolve := func(utoks []sse.UpdateToken, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve(docs.Update(
+		sse.Change[string]{FileID: "notes/hello.txt", Diff: emys.Diff(nil, []byte("Hello, Gopher!"))},
+		sse.Change[string]{FileID: "notes/world.txt", Diff: emys.Diff(nil, []byte("Hello, 世界"))},
+	))
+	if _, err := docs.Update(sse.Change[string]{FileID: "notes/full.txt", Diff: emys.Diff(nil, []byte("Gopher"))}); err == nil {
+		t.Fatalf("update beyond capacity was accepted")
+	}
+	got := search("hello")
+	slices.Sort(got)
+	if want := []string{"notes/hello.txt", "notes/world.txt"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	slot, _ := docs.Slot("notes/hello.txt")
+	resolve(docs.Delete("notes/hello.txt"))
+	resolve(docs.Update(sse.Change[string]{FileID: "notes/gopher.txt", Diff: emys.Diff(nil, []byte("Gopher"))}))
+	if reused, _ := docs.Slot("notes/gopher.txt"); reused != slot {
+		t.Errorf("got slot %d for new document, want freed slot %d", reused, slot)
+	}
+
+	state, err := docs.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs = emys.NewDocuments[string](client)
+	if err := docs.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := search("Gopher"), []string{"notes/gopher.txt"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := search("hello"), []string{"notes/world.txt"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The file cache is part of the state, so documents can still be deleted.
+	resolve(docs.Delete("notes/gopher.txt"))
+	if got := search("Gopher"); len(got) != 0 {
+		t.Errorf("got %q after deletion, want none", got)
+	}
+}
+
+func TestDocumentsState(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          2,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetDevice("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	client.EnableFileCache()
+	docs := emys.NewDocuments[string](client)
+	if _, err := docs.Update(sse.Change[string]{FileID: "notes/hello.txt", Diff: emys.Diff(nil, []byte("Hello, Gopher!"))}); err != nil {
+		t.Fatal(err)
+	}
+	next, _, err := client.Rotate([]byte("BLACK WIZARDRY, YELLOW SUBMARINE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload := func(docs *emys.Documents[string], key []byte) *emys.Client {
+		state, err := docs.State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := emys.NewDocuments[string](client).LoadState(state); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	old := reload(docs, key)
+	if old.Device() != "laptop" || old.Epoch() != 0 {
+		t.Errorf("got device %q at epoch %d, want laptop at 0", old.Device(), old.Epoch())
+	}
+	if _, err := old.Update(sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("Gopher"))}); !errors.Is(err, emys.ErrKeyRotated) {
+		t.Errorf("update of a rotated client: got %v, want %v", err, emys.ErrKeyRotated)
+	}
+	if _, err := old.CutOver(); err != nil {
+		t.Errorf("cut-over of a rotated client: %v", err)
+	}
+
+	reloaded := reload(emys.NewDocuments[string](next), []byte("BLACK WIZARDRY, YELLOW SUBMARINE"))
+	if reloaded.Device() != "laptop" || reloaded.Epoch() != 1 {
+		t.Errorf("got device %q at epoch %d, want laptop at 1", reloaded.Device(), reloaded.Epoch())
+	}
+}
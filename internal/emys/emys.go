@@ -2,12 +2,17 @@ package emys
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
-	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"maps"
 	"slices"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/zeebo/blake3"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -23,30 +28,68 @@ const (
 	authenticationKeyLabel = "index authentication"
 	updateKeyLabel         = "update token derivation"
 	clientStateKeyLabel    = "client state dump encryption"
+	searchTokenKeyLabel    = "internal search token derivation"
 )
 
+// streamChunkSize is how much of an index is processed at a time.
+const streamChunkSize = 64 * ahe.BlockSize
+
 type Query struct {
 	Text string
 
+	// Range, if set, restricts the search to the segments holding the files
+	// in it, and the results to those files.
+	Range *FileRange
+
 	precomputedTrigrams []string
 }
 
+// FileRange holds the file identifiers from From up to To, excluded.
+type FileRange struct {
+	From, To uint64
+}
+
 type Client struct {
 	key          []byte
 	userNonce    []byte
 	integrityKey []byte
 	state        map[string]clientState
+	files        map[uint64][]string
 	config       *Config
+
+	// device namespaces the chains in state, and log sums up the updates
+	// that wrote them. The chains of other devices sharing the index are
+	// kept in peers.
+	device string
+	log    updateLog
+	peers  map[string]deviceState
+
+	// backupVersion is the version of the last backup the server accepted.
+	backupVersion uint64
+
+	// epoch counts the key rotations of the index, and rotated is set once
+	// the client key is replaced by Rotate.
+	epoch   uint64
+	rotated bool
+
+	random io.Reader
 }
 
 var (
-	_ sse.Searcher[uint64] = &Client{}
-	_ sse.Updater[uint64]  = &Client{}
+	_ sse.ContextSearcher[uint64] = &Client{}
+	_ sse.ContextUpdater[uint64]  = &Client{}
 )
 
-type clientState struct {
+// clientState holds the chains of a trigram, by segment.
+type clientState map[uint64]chainState
+
+type chainState struct {
 	UpdateCount         int64
 	InternalSearchToken []byte
+
+	// CompactedAt is the UpdateCount of the chain when the client last asked
+	// the server to compact it, by searching or otherwise.
+	CompactedAt int64
 }
 
 func NewClient(key, userNonce []byte, config *Config) (*Client, error) {
@@ -65,93 +108,181 @@ func NewClient(key, userNonce []byte, config *Config) (*Client, error) {
 		integrityKey: ahmac.UniformKey(deriveKey(key, string(userNonce), integrityKeyLabel)),
 		state:        make(map[string]clientState),
 		config:       config,
+		random:       rand.Reader,
 	}
 	return c, nil
 }
 
+type clientDump struct {
+	Chains        map[string]clientState
+	BackupVersion uint64
+	Device        string
+	Log           updateLog
+	Peers         map[string]deviceState
+	Epoch         uint64
+	Rotated       bool
+}
+
 func (c *Client) State() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(c.state); err != nil {
+	if err := enc.Encode(c.dump()); err != nil {
 		return nil, fmt.Errorf("failed to encode client state: %w", err)
 	}
-	key := deriveKey(c.key, string(c.userNonce), clientStateKeyLabel)
+	return c.sealState(clientStateKeyLabel, "client state dump", buf.Bytes())
+}
+
+func (c *Client) LoadState(state []byte) error {
+	plaintext, err := c.openState(clientStateKeyLabel, "client state dump", "client state", state)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client state: %w", err)
+	}
+	var dump clientDump
+	dec := gob.NewDecoder(bytes.NewBuffer(plaintext))
+	if err := dec.Decode(&dump); err != nil {
+		return fmt.Errorf("failed to decode client state: %w", err)
+	}
+	c.restore(dump)
+	return nil
+}
+
+// dump returns everything State saves. The random source is not part of it.
+func (c *Client) dump() clientDump {
+	return clientDump{
+		Chains:        c.state,
+		BackupVersion: c.backupVersion,
+		Device:        c.device,
+		Log:           c.log,
+		Peers:         c.peers,
+		Epoch:         c.epoch,
+		Rotated:       c.rotated,
+	}
+}
+
+func (c *Client) restore(dump clientDump) {
+	if dump.Chains == nil {
+		dump.Chains = make(map[string]clientState)
+	}
+	for id, peer := range dump.Peers {
+		if peer.Chains == nil {
+			peer.Chains = make(map[string]clientState)
+			dump.Peers[id] = peer
+		}
+	}
+	c.state = dump.Chains
+	c.backupVersion = dump.BackupVersion
+	c.device = dump.Device
+	c.log = dump.Log
+	c.peers = dump.Peers
+	c.epoch = dump.Epoch
+	c.rotated = dump.Rotated
+}
+
+func (c *Client) seal(keyLabel, additionalData string, plaintext []byte) ([]byte, error) {
+	key := deriveKey(c.key, string(c.userNonce), keyLabel)
 	aead, err := chacha20poly1305.New(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize aead cipher: %w", err)
 	}
-	nonce := make([]byte, aead.NonceSize())
-	rand.Read(nonce)
-	ciphertext := aead.Seal(nil, nonce, buf.Bytes(), []byte("client state dump"))
+	nonce, err := c.readRandom("nonce", aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, nonce, plaintext, []byte(additionalData))
 	return append(nonce, ciphertext...), nil
 }
 
-func (c *Client) LoadState(state []byte) error {
-	key := deriveKey(c.key, string(c.userNonce), clientStateKeyLabel)
+func (c *Client) open(keyLabel, additionalData string, sealed []byte) ([]byte, error) {
+	key := deriveKey(c.key, string(c.userNonce), keyLabel)
 	aead, err := chacha20poly1305.New(key)
 	if err != nil {
-		return fmt.Errorf("failed to initialize aead cipher: %w", err)
+		return nil, fmt.Errorf("failed to initialize aead cipher: %w", err)
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("sealed data too short")
 	}
-	nonce := state[:aead.NonceSize()]
-	ciphertext := state[aead.NonceSize():]
-	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte("client state dump"))
+	nonce := sealed[:aead.NonceSize()]
+	ciphertext := sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(additionalData))
+}
+
+// sealState seals a state bound to the config. Its fingerprint is also put in
+// front of the sealed state, so that a config mismatch is told apart from a
+// wrong key or a corrupted state.
+func (c *Client) sealState(keyLabel, additionalData string, plaintext []byte) ([]byte, error) {
+	fingerprint := c.config.Fingerprint()
+	sealed, err := c.seal(keyLabel, additionalData+string(fingerprint), plaintext)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt client state: %w", err)
+		return nil, err
 	}
-	dec := gob.NewDecoder(bytes.NewBuffer(plaintext))
-	if err := dec.Decode(&c.state); err != nil {
-		return fmt.Errorf("failed to decode client state: %w", err)
+	return append(fingerprint, sealed...), nil
+}
+
+func (c *Client) openState(keyLabel, additionalData, object string, sealed []byte) ([]byte, error) {
+	if len(sealed) < fingerprintSize {
+		return nil, fmt.Errorf("sealed data too short")
 	}
-	return nil
+	fingerprint := sealed[:fingerprintSize]
+	if err := c.config.checkFingerprint(object, fingerprint); err != nil {
+		return nil, err
+	}
+	return c.open(keyLabel, additionalData+string(fingerprint), sealed[fingerprintSize:])
 }
 
 func (c *Client) Search(query sse.Query) (sse.SearchToken, error) {
-	searchQuery := new(Query)
-	switch q := query.(type) {
-	case *Query:
-		searchQuery = q
-	case Query:
-		searchQuery = &q
-	case string:
-		searchQuery.Text = q
-	default:
-		return nil, fmt.Errorf("unexpected query type: %T", query)
+	return c.SearchContext(context.Background(), query)
+}
+
+func (c *Client) SearchContext(ctx context.Context, query sse.Query) (sse.SearchToken, error) {
+	searchQuery, err := c.config.parseQuery(query, c.known)
+	if err != nil {
+		return nil, err
 	}
-	if len(searchQuery.Text) < 3 {
-		return nil, fmt.Errorf("query too short")
+	q := searchQuery.precomputedTrigrams
+	if len(q) == 0 {
+		return nil, nil
 	}
-	if searchQuery.precomputedTrigrams == nil {
-		q := trigrams(searchQuery.Text)
-		searchQuery.precomputedTrigrams = slices.DeleteFunc(q, func(trigram string) bool {
-			_, ok := c.state[trigram]
-			return !ok
-		})
+	segs := c.config.targetedSegments(searchQuery.Range)
+	stok := c.searchTokens(q, segs)
+	if len(stok) > c.config.maxSearchChains() {
+		return nil, fmt.Errorf("%w: %d chains across devices, at most %d", ErrQueryTooLong, len(stok), c.config.maxSearchChains())
+	}
+	token := encodeSearchTokens(stok)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.markCompacted(q, segs)
+	return token, nil
+}
+
+func (c *Client) OpenResult(query sse.Query, result sse.SearchResult) ([]uint64, error) {
+	return c.OpenResultContext(context.Background(), query, result)
+}
+
+func (c *Client) OpenResultContext(ctx context.Context, query sse.Query, result sse.SearchResult) ([]uint64, error) {
+	searchQuery, err := c.config.parseQuery(query, c.known)
+	if err != nil {
+		return nil, err
 	}
 	q := searchQuery.precomputedTrigrams
 	if len(q) == 0 {
 		return nil, nil
 	}
-	if len(q) > int(c.config.MaxSearchTrigrams) {
-		return nil, fmt.Errorf("query too long")
-	}
-	stok := make([]searchToken, len(q))
-	for i, trigram := range q {
-		updateKey := deriveKey(c.key, string(c.userNonce), updateKeyLabel, trigram)
-		stok[i] = searchToken{
-			UpdateCount:         c.state[trigram].UpdateCount,
-			InternalSearchToken: c.state[trigram].InternalSearchToken,
-			UpdateKey:           updateKey,
-		}
+	res, err := decodeSearchResult(result)
+	if err != nil {
+		return nil, err
 	}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(stok); err != nil {
-		return nil, fmt.Errorf("failed to encode search token: %w", err)
+	segs := c.config.targetedSegments(searchQuery.Range)
+	indexes, err := c.openIndexes(ctx, q, segs, res)
+	if err != nil {
+		return nil, err
 	}
-	return buf.Bytes(), nil
+	return c.config.matches(searchQuery, segs, indexes)
 }
 
-func (c *Client) OpenResult(query sse.Query, result sse.SearchResult) ([]uint64, error) {
+// parseQuery converts a query to a *Query and extracts the trigrams for which
+// known reports a chain, once.
+func (c *Config) parseQuery(query sse.Query, known func(trigram string) bool) (*Query, error) {
 	searchQuery := new(Query)
 	switch q := query.(type) {
 	case *Query:
@@ -163,47 +294,155 @@ func (c *Client) OpenResult(query sse.Query, result sse.SearchResult) ([]uint64,
 	default:
 		return nil, fmt.Errorf("unexpected query type: %T", query)
 	}
-	if len(searchQuery.Text) < 3 {
-		return nil, fmt.Errorf("query too short")
+	if n := utf8.RuneCountInString(searchQuery.Text); n < 3 {
+		return nil, &QueryError{Err: ErrQueryTooShort, Characters: n}
 	}
 	if searchQuery.precomputedTrigrams == nil {
 		q := trigrams(searchQuery.Text)
 		searchQuery.precomputedTrigrams = slices.DeleteFunc(q, func(trigram string) bool {
-			_, ok := c.state[trigram]
-			return !ok
+			return !known(trigram)
 		})
 	}
-	q := searchQuery.precomputedTrigrams
-	if len(q) == 0 {
-		return nil, nil
+	if n := len(searchQuery.precomputedTrigrams); n > int(c.MaxSearchTrigrams) {
+		return nil, &QueryError{Err: ErrQueryTooLong, Trigrams: n, MaxTrigrams: int(c.MaxSearchTrigrams)}
 	}
-	if len(q) > int(c.config.MaxSearchTrigrams) {
-		return nil, fmt.Errorf("query too long")
+	return searchQuery, nil
+}
+
+// matches returns the files whose counters in the decrypted indexes reach the
+// search threshold of the query.
+func (c *Config) matches(searchQuery *Query, segs []segment, indexes map[uint64][]byte) ([]uint64, error) {
+	ids := make([]uint64, 0, 32)
+	threshold := c.SearchThreshold * float64(len(trigrams(searchQuery.Text)))
+	for _, seg := range segs {
+		index, ok := indexes[seg.Start]
+		if !ok {
+			continue
+		}
+		layout := c.layout(seg)
+		// The first block lies at the end of the index, so decoding from the
+		// end keeps identifiers in ascending order.
+		for end := len(index); end > 0; end -= streamChunkSize {
+			chunk := index[max(end-streamChunkSize, 0):end]
+			block := uint64(len(index)-end) / ahe.BlockSize
+			err := layout.Decode(chunk, block, func(i, matches uint64) {
+				if matches < uint64(threshold) {
+					return
+				}
+				id := seg.Start + i
+				if r := searchQuery.Range; r == nil || (id >= r.From && id < r.To) {
+					ids = append(ids, id)
+				}
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode counters of segment %d: %w", seg.Start, err)
+			}
+		}
 	}
-	var res searchResult
-	dec := gob.NewDecoder(bytes.NewBuffer(result))
-	if err := dec.Decode(&res); err != nil {
-		return nil, fmt.Errorf("failed to decode search result: %w", err)
+	return ids, nil
+}
+
+// chainKey derives a key bound to the chain of a trigram written by a device
+// in a segment. The first segment, the unnamed device and the first key epoch
+// keep the contexts used before the index could grow, be shared or be
+// re-keyed.
+func (c *Client) chainKey(label, device, trigram string, seg uint64, contexts ...string) []byte {
+	ctx := []string{string(c.userNonce), label, trigram}
+	if seg != 0 {
+		ctx = append(ctx, fmt.Sprintf("segment %d", seg))
 	}
-	encryptionKey := make([]byte, ahe.BlockSize*c.config.indexBlocks())
-	authenticationKey := make([]byte, ahmac.Size)
+	if device != "" {
+		ctx = append(ctx, "device "+device)
+	}
+	if c.epoch != 0 {
+		ctx = append(ctx, fmt.Sprintf("epoch %d", c.epoch))
+	}
+	return deriveKey(c.key, append(ctx, contexts...)...)
+}
+
+// internalSearchToken returns the token of the newest entry of a chain, which
+// is only stored if it was random when the entry was added.
+func (c *Client) internalSearchToken(device, trigram string, seg uint64, chain chainState) []byte {
+	if chain.InternalSearchToken != nil {
+		return chain.InternalSearchToken
+	}
+	return c.chainKey(searchTokenKeyLabel, device, trigram, seg, fmt.Sprintf("%d", chain.UpdateCount))
+}
+
+func (c *Client) searchTokens(q []string, segs []segment) []searchToken {
+	fingerprint := c.config.Fingerprint()
+	stok := make([]searchToken, 0, len(q))
 	for _, trigram := range q {
-		for count := c.state[trigram].UpdateCount; count >= 0; count-- {
-			seed := deriveKey(
-				c.key, string(c.userNonce), encryptionKeyLabel,
-				trigram, fmt.Sprintf("%d", count),
-			)
-			ekey, err := ahe.KeyFromSeed(seed, c.config.indexBlocks())
-			if err != nil {
-				return nil, fmt.Errorf("failed to generate encryption key: %w", err)
-			}
-			if err := ahe.Add(encryptionKey, ekey); err != nil {
-				return nil, fmt.Errorf("failed to add encryption keys: %w", err)
-			}
-			akey := ahmac.UniformKey(deriveKey(
-				c.key, string(c.userNonce), authenticationKeyLabel,
-				trigram, fmt.Sprintf("%d", count),
-			))
+		for _, seg := range segs {
+			c.devices(func(device string, chains map[string]clientState) {
+				chain, ok := chains[trigram][seg.Start]
+				if !ok {
+					return
+				}
+				stok = append(stok, searchToken{
+					Config:              fingerprint,
+					Epoch:               c.epoch,
+					Segment:             seg.Start,
+					UpdateCount:         chain.UpdateCount,
+					InternalSearchToken: c.internalSearchToken(device, trigram, seg.Start, chain),
+					UpdateKey:           c.chainKey(updateKeyLabel, device, trigram, seg.Start),
+				})
+			})
+		}
+	}
+	return stok
+}
+
+// openIndexes verifies and decrypts the index of every given segment in which
+// at least one of the trigrams has a chain.
+func (c *Client) openIndexes(ctx context.Context, q []string, segs []segment, res searchResult) (map[uint64][]byte, error) {
+	want := 0
+	for _, seg := range segs {
+		if slices.ContainsFunc(q, func(trigram string) bool {
+			return c.hasChain(trigram, seg.Start)
+		}) {
+			want++
+		}
+	}
+	if len(res.Segments) != want {
+		return nil, fmt.Errorf("%w: covers %d segments, want %d", ErrMalformedResult, len(res.Segments), want)
+	}
+	indexes := make(map[uint64][]byte, len(res.Segments))
+	for _, segRes := range res.Segments {
+		i, ok := slices.BinarySearchFunc(segs, segRes.Segment, func(seg segment, start uint64) int {
+			return cmp.Compare(seg.Start, start)
+		})
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected segment %d", ErrMalformedResult, segRes.Segment)
+		}
+		seg := segs[i]
+		if _, ok := indexes[seg.Start]; ok {
+			return nil, fmt.Errorf("%w: duplicate segment %d", ErrMalformedResult, seg.Start)
+		}
+		index, err := c.openIndex(ctx, q, seg, segRes)
+		if err != nil {
+			return nil, &SegmentError{Segment: seg.Start, Trigrams: c.segmentTrigrams(q, seg.Start), Err: err}
+		}
+		indexes[seg.Start] = index
+	}
+	return indexes, nil
+}
+
+// openIndex verifies the encrypted index of a segment and decrypts it in
+// place, one chain entry key at a time, so that no index-sized key is ever
+// held unless entries are decrypted in parallel.
+func (c *Client) openIndex(ctx context.Context, q []string, seg segment, res segmentResult) ([]byte, error) {
+	chains := c.segmentChains(q, seg.Start)
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("%w: no chain in segment", ErrMalformedResult)
+	}
+	if err := c.config.checkIndexLength("search result", seg, res.EncryptedIndex); err != nil {
+		return nil, err
+	}
+	authenticationKey := make([]byte, ahmac.Size)
+	for _, chain := range chains {
+		for count := chain.count; count >= 0; count-- {
+			akey := ahmac.UniformKey(c.chainKey(authenticationKeyLabel, chain.device, chain.trigram, seg.Start, fmt.Sprintf("%d", count)))
 			if err := ahmac.Add(authenticationKey, akey); err != nil {
 				return nil, fmt.Errorf("failed to add authentication keys: %w", err)
 			}
@@ -214,43 +453,83 @@ func (c *Client) OpenResult(query sse.Query, result sse.SearchResult) ([]uint64,
 		return nil, fmt.Errorf("failed to compute index tag: %w", err)
 	}
 	if subtle.ConstantTimeCompare(res.Tag, tag) == 0 {
-		return nil, fmt.Errorf("invalid tag")
+		return nil, ErrInvalidTag
 	}
-	index, err := ahe.Decrypt(encryptionKey, res.EncryptedIndex)
+	index := res.EncryptedIndex
+	workers := min(max(c.config.Workers, 1), len(chains))
+	if workers == 1 {
+		for _, chain := range chains {
+			if err := c.applyChainKeys(ctx, index, chain, seg, (*ahe.KeyStream).Sub); err != nil {
+				return nil, err
+			}
+		}
+		return index, nil
+	}
+	// Each worker sums the keys of its chains into an accumulator of its own.
+	accs := make(chan []byte, workers)
+	for range workers {
+		accs <- make([]byte, len(index))
+	}
+	err = parallel(ctx, workers, len(chains), func(i int) error {
+		acc := <-accs
+		defer func() { accs <- acc }()
+		return c.applyChainKeys(ctx, acc, chains[i], seg, (*ahe.KeyStream).Add)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt index: %w", err)
+		return nil, err
 	}
-	bs := bitset.NewFromBytes(index, c.config.indexBitLen())
-	ids := make([]uint64, 0, 32)
-	usableBits := c.config.MaxFiles * c.config.fileBitLen()
-	threshold := c.config.SearchThreshold * float64(len(trigrams(searchQuery.Text)))
-	for i := uint64(0); i < usableBits; i += c.config.fileBitLen() {
-		fileBytes, err := bs.BitsAt(i, c.config.fileBitLen())
+	close(accs)
+	for acc := range accs {
+		if err := ahe.Sub(index, acc); err != nil {
+			return nil, fmt.Errorf("failed to decrypt index: %w", err)
+		}
+	}
+	return index, nil
+}
+
+// applyChainKeys applies to dst the encryption key of every entry in a chain.
+func (c *Client) applyChainKeys(ctx context.Context, dst []byte, chain chainRef, seg segment, apply func(*ahe.KeyStream, []byte) error) error {
+	for count := chain.count; count >= 0; count-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ks, err := ahe.NewKeyStream(c.chainKey(encryptionKeyLabel, chain.device, chain.trigram, seg.Start, fmt.Sprintf("%d", count)))
 		if err != nil {
-			return nil, fmt.Errorf(
-				"failed to retrieve index bits from %d to %d: %w",
-				i, i+c.config.fileBitLen()-1, err,
-			)
+			return fmt.Errorf("failed to generate encryption key: %w", err)
 		}
-		matches := binary.BigEndian.Uint16(fileBytes)
-		if matches >= uint16(threshold) {
-			ids = append(ids, i/c.config.fileBitLen())
+		if err := apply(ks, dst); err != nil {
+			return fmt.Errorf("failed to apply encryption key: %w", err)
 		}
 	}
-	return ids, nil
+	return nil
 }
 
 func (c *Client) Update(changes ...sse.Change[uint64]) ([]sse.UpdateToken, error) {
+	return c.UpdateContext(context.Background(), changes...)
+}
+
+// UpdateContext is like Update, but gives up once ctx is done. Chains only
+// advance after every token is built, so a cancelled update leaves no trace.
+func (c *Client) UpdateContext(ctx context.Context, changes ...sse.Change[uint64]) ([]sse.UpdateToken, error) {
+	if c.rotated {
+		return nil, ErrKeyRotated
+	}
 	removed := make(map[string][]uint64)
 	inserted := make(map[string][]uint64)
+	staged := make(map[uint64][]string)
 	for _, change := range changes {
 		if change.FileID >= c.config.MaxFiles {
-			return nil, fmt.Errorf("file identifier out of range: %d", change.FileID)
+			return nil, &FileIDError{FileID: change.FileID, MaxFiles: c.config.MaxFiles}
 		}
 		rem, ins, err := ParseDiff(change.Diff)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse diff: %w", err)
 		}
+		if c.files != nil {
+			if err := c.stageFileChange(staged, change.FileID, rem, ins); err != nil {
+				return nil, fmt.Errorf("inconsistent change: %w", err)
+			}
+		}
 		for _, trigram := range rem {
 			removed[trigram] = append(removed[trigram], change.FileID)
 		}
@@ -258,20 +537,88 @@ func (c *Client) Update(changes ...sse.Change[uint64]) ([]sse.UpdateToken, error
 			inserted[trigram] = append(inserted[trigram], change.FileID)
 		}
 	}
-	out := make([]sse.UpdateToken, 0, len(removed)+len(inserted))
-	for trigram, ids := range removed {
-		utok, err := c.update(ids, trigram, opDel)
-		if err != nil {
+	segs := c.config.segments()
+	var pending []pendingUpdate
+	heads := make(map[string]clientState)
+	plan := func(trigram string, ids []uint64, op updateOp) error {
+		if heads[trigram] == nil {
+			heads[trigram] = make(clientState)
+		}
+		for _, seg := range c.config.touchedSegments(segs, ids) {
+			u := pendingUpdate{trigram: trigram, seg: seg, op: op, ids: ids}
+			chain, ok := heads[trigram][seg.Start]
+			if !ok {
+				chain, ok = c.state[trigram][seg.Start]
+			}
+			if ok {
+				u.count = chain.UpdateCount + 1
+				u.istok = c.internalSearchToken(c.device, trigram, seg.Start, chain)
+				u.compactedAt = chain.CompactedAt
+			} else {
+				istok, err := c.readRandom("internal search token", 32)
+				if err != nil {
+					return err
+				}
+				u.istok = istok
+			}
+			head := chainState{
+				UpdateCount: u.count,
+				CompactedAt: u.compactedAt,
+			}
+			if c.config.DerivedSearchTokens {
+				u.nextIstok = c.internalSearchToken(c.device, trigram, seg.Start, head)
+			} else {
+				nextIstok, err := c.readRandom("internal search token", 32)
+				if err != nil {
+					return err
+				}
+				u.nextIstok = nextIstok
+				head.InternalSearchToken = nextIstok
+			}
+			heads[trigram][seg.Start] = head
+			pending = append(pending, u)
+		}
+		return nil
+	}
+	for _, trigram := range slices.Sorted(maps.Keys(removed)) {
+		if err := plan(trigram, removed[trigram], opDel); err != nil {
+			return nil, err
+		}
+	}
+	for _, trigram := range slices.Sorted(maps.Keys(inserted)) {
+		if err := plan(trigram, inserted[trigram], opAdd); err != nil {
 			return nil, err
 		}
-		out = append(out, utok)
 	}
-	for trigram, ids := range inserted {
-		utok, err := c.update(ids, trigram, opAdd)
+	log := c.log
+	if len(pending) > 0 {
+		updateID, err := c.readRandom("update identifier", updateIDSize)
 		if err != nil {
 			return nil, err
 		}
-		out = append(out, utok)
+		log = log.append(updateID)
+	}
+	out := make([]sse.UpdateToken, len(pending))
+	err := parallel(ctx, c.config.Workers, len(pending), func(i int) error {
+		utok, err := c.update(ctx, pending[i], log)
+		out[i] = utok
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for trigram, chains := range heads {
+		if c.state[trigram] == nil {
+			c.state[trigram] = make(clientState)
+		}
+		maps.Copy(c.state[trigram], chains)
+	}
+	c.log = log
+	if c.files != nil {
+		c.commitFileChanges(staged)
 	}
 	return out, nil
 }
@@ -283,28 +630,25 @@ const (
 	opDel
 )
 
-func (c *Client) update(ids []uint64, trigram string, op updateOp) (sse.UpdateToken, error) {
-	var count int64
-	var istok []byte
-
-	state, ok := c.state[trigram]
-	if !ok {
-		count = -1
-		istok = make([]byte, 32)
-		rand.Read(istok)
-	} else {
-		count = state.UpdateCount
-		istok = state.InternalSearchToken
-	}
-
-	nextIstok := make([]byte, 32)
-	rand.Read(nextIstok)
-	c.state[trigram] = clientState{
-		UpdateCount:         count + 1,
-		InternalSearchToken: nextIstok,
-	}
+// pendingUpdate is an entry to append to the chain of a trigram in a
+// segment, with the chain state already advanced by Update.
+type pendingUpdate struct {
+	trigram     string
+	seg         segment
+	op          updateOp
+	ids         []uint64
+	count       int64
+	compactedAt int64
+	istok       []byte
+	nextIstok   []byte
+}
 
-	updateKey := deriveKey(c.key, string(c.userNonce), updateKeyLabel, trigram)
+// update builds the token of a chain entry, setting the counters of the files
+// in ids that belong to the segment, for the update that brings the device
+// log to log. It does not touch the client state.
+func (c *Client) update(ctx context.Context, u pendingUpdate, log updateLog) (sse.UpdateToken, error) {
+	trigram, seg := u.trigram, u.seg
+	updateKey := c.chainKey(updateKeyLabel, c.device, trigram, seg.Start)
 	updateKeyH1 := deriveKey(updateKey, "h1")
 	updateKeyH2 := deriveKey(updateKey, "h2")
 	h1, err := blake3.NewKeyed(updateKeyH1)
@@ -316,195 +660,554 @@ func (c *Client) update(ids []uint64, trigram string, op updateOp) (sse.UpdateTo
 		return nil, fmt.Errorf("failed to initialize h2: %w", err)
 	}
 
-	nextIutok := h1.Sum(nextIstok)
+	nextIutok := h1.Sum(u.nextIstok)
 	maskedIstok := make([]byte, 32)
-	subtle.XORBytes(maskedIstok, istok, h2.Sum(nextIstok))
+	subtle.XORBytes(maskedIstok, u.istok, h2.Sum(u.nextIstok))
 
-	bs := bitset.New(c.config.indexBitLen())
-	for _, id := range ids {
-		bs.Set(id * c.config.fileBitLen())
+	layout := c.config.layout(seg)
+	bs := bitset.New(layout.Len())
+	for _, id := range u.ids {
+		if id >= seg.Start && id < seg.Start+seg.Files {
+			bs.Set(layout.Offset(id - seg.Start))
+		}
 	}
-	if op == opDel {
+	if u.op == opDel {
 		if err := bs.Neg(); err != nil {
 			return nil, fmt.Errorf("failed to negate index: %w", err)
 		}
 	}
 
-	seed := deriveKey(
-		c.key, string(c.userNonce), encryptionKeyLabel,
-		trigram, fmt.Sprintf("%d", count+1),
-	)
-	encryptionKey, err := ahe.KeyFromSeed(seed, c.config.indexBlocks())
+	ks, err := ahe.NewKeyStream(c.chainKey(encryptionKeyLabel, c.device, trigram, seg.Start, fmt.Sprintf("%d", u.count)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
 	}
-	encryptedIndex, err := ahe.Encrypt(encryptionKey, bs.Bytes())
+	authenticationKey := ahmac.UniformKey(c.chainKey(
+		authenticationKeyLabel, c.device, trigram, seg.Start, fmt.Sprintf("%d", u.count),
+	))
+	mac, err := ahmac.New(c.integrityKey, authenticationKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt index: %w", err)
+		return nil, fmt.Errorf("failed to initialize index tag: %w", err)
 	}
-
-	authenticationKey := ahmac.UniformKey(deriveKey(
-		c.key, string(c.userNonce), authenticationKeyLabel,
-		trigram, fmt.Sprintf("%d", count+1),
-	))
-	tag, err := ahmac.MAC(c.integrityKey, authenticationKey, encryptedIndex)
+	// The index is encrypted in place and tagged a chunk at a time, while the
+	// chunk is still in cache.
+	encryptedIndex := bs.Bytes()
+	for chunk := range slices.Chunk(encryptedIndex, streamChunkSize) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := ks.Add(chunk); err != nil {
+			return nil, fmt.Errorf("failed to encrypt index: %w", err)
+		}
+		mac.Write(chunk)
+	}
+	tag, err := mac.Sum()
 	if err != nil {
 		return nil, fmt.Errorf("failed to compute index tag: %w", err)
 	}
 
 	utok := updateToken{
+		Config:                    c.config.Fingerprint(),
+		Epoch:                     c.epoch,
+		Segment:                   seg.Start,
 		NextInternalUpdateToken:   nextIutok,
 		MaskedInternalSearchToken: maskedIstok,
 		EncryptedIndex:            encryptedIndex,
 		Tag:                       tag,
+		Device:                    c.deviceID(),
+		Log:                       c.log.Hash,
+		NextLog:                   log.Hash,
 	}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(utok); err != nil {
-		return nil, fmt.Errorf("failed to encode update token: %w", err)
+	return encodeUpdateToken(utok), nil
+}
+
+// Grow adds capacity for files up to maxFiles, and returns the grown config.
+// States saved from then on are bound to it, so it is the one to pass to
+// NewClient before loading them.
+func (c *Client) Grow(maxFiles uint64) (*Config, error) {
+	config, err := c.config.Grow(maxFiles)
+	if err != nil {
+		return nil, err
 	}
-	return buf.Bytes(), nil
+	c.config = config
+	return config, nil
 }
 
 type Server struct {
-	state  map[string]serverState
+	store  Store
 	config *Config
+
+	backupMu sync.Mutex
+	// epochMu is held for writing while the index is cut over to a new key
+	// epoch or grown, and for reading while tokens are resolved, from their
+	// decoding on, since that depends on the config too.
+	epochMu sync.RWMutex
 }
 
 var (
-	_ sse.SearchResolver = &Server{}
-	_ sse.UpdateResolver = &Server{}
+	_ sse.ContextSearchResolver = &Server{}
+	_ sse.ContextUpdateResolver = &Server{}
 )
 
-type serverState struct {
-	MaskedInternalSearchToken []byte
-	EncryptedIndex            []byte
-	Tag                       []byte
+// NewServer returns a server keeping its chain entries in memory.
+func NewServer(config *Config) (*Server, error) {
+	return NewServerWithStore(config, NewMemoryStore())
 }
 
-func NewServer(config *Config) (*Server, error) {
+func NewServerWithStore(config *Config, store Store) (*Server, error) {
 	if err := config.validate(); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 	s := &Server{
-		state:  make(map[string]serverState),
+		store:  store,
 		config: config,
 	}
 	return s, nil
 }
 
+// State returns every entry of the store in a single blob. Durable stores do
+// not need it, but it still works as a portable snapshot.
 func (s *Server) State() ([]byte, error) {
+	state := make(map[string]Entry)
+	err := s.store.Keys(func(key []byte) error {
+		entry, ok, err := s.store.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			state[string(key)] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read server state: %w", err)
+	}
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(s.state); err != nil {
+	if err := enc.Encode(state); err != nil {
 		return nil, fmt.Errorf("failed to encode server state: %w", err)
 	}
 	return buf.Bytes(), nil
 }
 
+// LoadState replaces the content of the store with a State blob.
 func (s *Server) LoadState(state []byte) error {
+	var entries map[string]Entry
 	dec := gob.NewDecoder(bytes.NewBuffer(state))
-	if err := dec.Decode(&s.state); err != nil {
+	if err := dec.Decode(&entries); err != nil {
 		return fmt.Errorf("failed to decode server state: %w", err)
 	}
+	var b Batch
+	err := s.store.Keys(func(key []byte) error {
+		if _, ok := entries[string(key)]; !ok {
+			b.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read server state: %w", err)
+	}
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		b.Put([]byte(key), entries[key])
+	}
+	if err := s.store.Apply(&b); err != nil {
+		return fmt.Errorf("failed to store server state: %w", err)
+	}
+	return nil
+}
+
+// Grow adds capacity for files up to maxFiles, waiting for the tokens being
+// resolved.
+func (s *Server) Grow(maxFiles uint64) error {
+	s.epochMu.Lock()
+	defer s.epochMu.Unlock()
+	config, err := s.config.Grow(maxFiles)
+	if err != nil {
+		return err
+	}
+	s.config = config
 	return nil
 }
 
 func (s *Server) ResolveSearch(token sse.SearchToken) (sse.SearchResult, error) {
-	var stok []searchToken
-	dec := gob.NewDecoder(bytes.NewBuffer(token))
-	if err := dec.Decode(&stok); err != nil {
-		return nil, fmt.Errorf("failed to decode search token: %w", err)
+	return s.ResolveSearchContext(context.Background(), token)
+}
+
+// ResolveSearchContext is like ResolveSearch, but gives up once ctx is done.
+// The chains are walked and compacted in a single store transaction, whose
+// batch is only applied at the very end, so a cancelled search does not touch
+// the store.
+func (s *Server) ResolveSearchContext(ctx context.Context, token sse.SearchToken) (sse.SearchResult, error) {
+	s.epochMu.RLock()
+	defer s.epochMu.RUnlock()
+	stok, err := decodeSearchTokens(token, s.config.maxSearchTokenSize(), "search token")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSearchChains(stok); err != nil {
+		return nil, err
+	}
+	var res searchResult
+	err = s.transact(ctx, "compacted chains", func(get GetFunc) (*Batch, error) {
+		var compaction *Batch
+		var err error
+		res, _, compaction, err = s.resolveChains(ctx, get, stok)
+		return compaction, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeSearchResult(res), nil
+}
+
+// resolveChains sums the encrypted indexes and tags of chains that passed
+// checkSearchChains segment by segment, and returns the batch that compacts
+// them along with the keys of the compacted entries. Chains are walked
+// concurrently, since each walk just reads the state through get, which must
+// belong to the transaction that applies the batch. Each chain is added to
+// the sum of its segment as soon as it is walked, so only the chains that
+// compaction rewrites keep a sum of their own. The caller must hold epochMu.
+func (s *Server) resolveChains(ctx context.Context, get GetFunc, stok []searchToken) (searchResult, []string, *Batch, error) {
+	var res searchResult
+	type segmentSum struct {
+		sync.Mutex
+		segmentResult
 	}
-	encryptedIndexOut := make([]byte, ahe.BlockSize*s.config.indexBlocks())
-	tagOut := make([]byte, ahmac.Size)
+	out := make(map[uint64]*segmentSum)
 	for _, tok := range stok {
-		encryptedIndexAcc := make([]byte, ahe.BlockSize*s.config.indexBlocks())
-		tagAcc := make([]byte, ahmac.Size)
-		updateKeyH1 := deriveKey(tok.UpdateKey, "h1")
-		updateKeyH2 := deriveKey(tok.UpdateKey, "h2")
-		h1, err := blake3.NewKeyed(updateKeyH1)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize h1: %w", err)
+		seg, ok := s.config.segment(tok.Segment)
+		if !ok {
+			return searchResult{}, nil, nil, fmt.Errorf("%w: unknown segment %d", ErrMalformedToken, tok.Segment)
+		}
+		if _, ok := out[seg.Start]; !ok {
+			out[seg.Start] = &segmentSum{segmentResult: segmentResult{
+				Segment:        seg.Start,
+				EncryptedIndex: make([]byte, ahe.BlockSize*s.config.indexBlocks(seg)),
+				Tag:            make([]byte, ahmac.Size),
+			}}
+		}
+	}
+	resolved := make([]resolvedChain, len(stok))
+	err := parallel(ctx, s.config.Workers, len(stok), func(i int) error {
+		seg, _ := s.config.segment(stok[i].Segment)
+		chain, err := s.resolveChain(ctx, get, stok[i])
+		if err == nil {
+			sum := out[seg.Start]
+			sum.Lock()
+			err = addEntry(sum.EncryptedIndex, sum.Tag, chain.sum)
+			sum.Unlock()
 		}
-		h2, err := blake3.NewKeyed(updateKeyH2)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize h2: %w", err)
-		}
-		istok := tok.InternalSearchToken
-		var iutok []byte
-		for count := tok.UpdateCount; count >= 0; count-- {
-			iutok = h1.Sum(istok)
-			maskedIstok := s.state[string(iutok)].MaskedInternalSearchToken
-			encryptedIndex := s.state[string(iutok)].EncryptedIndex
-			tag := s.state[string(iutok)].Tag
-			delete(s.state, string(iutok))
-			if err := ahe.Add(encryptedIndexAcc, encryptedIndex); err != nil {
-				return nil, fmt.Errorf("failed to add encrypted indexes: %w", err)
-			}
-			if err := ahmac.Add(tagAcc, tag); err != nil {
-				return nil, fmt.Errorf("failed to add tags: %w", err)
-			}
-			if maskedIstok == nil {
-				break
-			}
-			subtle.XORBytes(istok, maskedIstok, h2.Sum(istok))
-			h1.Reset()
-			h2.Reset()
+			return &ChainError{Chain: i, Segment: seg.Start, Err: err}
 		}
-		s.state[string(iutok)] = serverState{
-			EncryptedIndex: encryptedIndexAcc,
-			Tag:            tagAcc,
+		if !chain.compact {
+			chain.sum = Entry{}
 		}
-		if err := ahe.Add(encryptedIndexOut, encryptedIndexAcc); err != nil {
-			return nil, fmt.Errorf("failed to add accumulated encrypted indexes: %w", err)
+		resolved[i] = chain
+		return nil
+	})
+	if err != nil {
+		return searchResult{}, nil, nil, err
+	}
+	heads := make([]string, 0, len(stok))
+	compaction := new(Batch)
+	for _, chain := range resolved {
+		head := chain.entries[0]
+		heads = append(heads, head)
+		if !chain.compact {
+			continue
 		}
-		if err := ahmac.Add(tagOut, tagAcc); err != nil {
-			return nil, fmt.Errorf("failed to add accumulated tags: %w", err)
+		// The sum replaces the newest entry, where the next walk of the
+		// chain starts, and it has no predecessor to end the walk there.
+		for _, iutok := range chain.entries[1:] {
+			compaction.Delete([]byte(iutok))
 		}
+		compaction.Put([]byte(head), chain.sum)
 	}
-	res := searchResult{
-		EncryptedIndex: encryptedIndexOut,
-		Tag:            tagOut,
+	for _, start := range slices.Sorted(maps.Keys(out)) {
+		res.Segments = append(res.Segments, out[start].segmentResult)
 	}
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(res); err != nil {
-		return nil, fmt.Errorf("failed to encode search result: %w", err)
+	return res, heads, compaction, nil
+}
+
+// apply stores a batch unless ctx is already done. Past this point a call is
+// no longer cancelled, since the batch is applied atomically.
+func (s *Server) apply(ctx context.Context, b *Batch, what string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return buf.Bytes(), nil
+	if err := s.store.Apply(b); err != nil {
+		return fmt.Errorf("failed to store %s: %w", what, err)
+	}
+	return nil
 }
 
-func (s *Server) ResolveUpdates(tokens ...sse.UpdateToken) error {
-	for _, token := range tokens {
-		var utok updateToken
-		dec := gob.NewDecoder(bytes.NewBuffer(token))
-		if err := dec.Decode(&utok); err != nil {
-			return fmt.Errorf("failed to decode update token: %w", err)
+// transact is like apply for a batch that fn builds from reads of the same
+// store transaction, such as the compaction of the chains fn walks. Other
+// batches cannot land in between, so two searches of a chain never delete
+// entries from under each other.
+func (s *Server) transact(ctx context.Context, what string, fn func(get GetFunc) (*Batch, error)) error {
+	var fnErr error
+	err := s.store.Transact(func(get GetFunc) (*Batch, error) {
+		b, err := fn(get)
+		if err == nil {
+			err = ctx.Err()
 		}
-		s.state[string(utok.NextInternalUpdateToken)] = serverState{
-			MaskedInternalSearchToken: utok.MaskedInternalSearchToken,
-			EncryptedIndex:            utok.EncryptedIndex,
-			Tag:                       utok.Tag,
+		fnErr = err
+		return b, err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %w", what, err)
+	}
+	return nil
+}
+
+// resolvedChain holds the keys of the entries of a chain, newest first, and
+// their sum. A chain that is already a single sum needs no compaction.
+type resolvedChain struct {
+	entries []string
+	sum     Entry
+	compact bool
+}
+
+// addEntry adds the encrypted index and tag of entry into index and tag.
+func addEntry(index, tag []byte, entry Entry) error {
+	if err := ahe.Add(index, entry.EncryptedIndex); err != nil {
+		return fmt.Errorf("failed to add encrypted indexes: %w", err)
+	}
+	if err := ahmac.Add(tag, entry.Tag); err != nil {
+		return fmt.Errorf("failed to add tags: %w", err)
+	}
+	return nil
+}
+
+// resolveChain walks a chain and sums its entries. The sum of a single entry
+// is the entry itself, so an accumulator is only made for longer chains, and
+// entries read through get are never written to.
+func (s *Server) resolveChain(ctx context.Context, get GetFunc, tok searchToken) (resolvedChain, error) {
+	var chain resolvedChain
+	err := s.walkChain(ctx, get, tok, func(iutok []byte, entry Entry) error {
+		if entry.Tag == nil {
+			return fmt.Errorf("%w: missing entry", ErrCorruptChain)
+		}
+		chain.entries = append(chain.entries, string(iutok))
+		switch len(chain.entries) {
+		case 1:
+			chain.sum = Entry{EncryptedIndex: entry.EncryptedIndex, Tag: entry.Tag}
+			chain.compact = entry.MaskedInternalSearchToken != nil
+			return nil
+		case 2:
+			chain.sum = Entry{
+				EncryptedIndex: slices.Clone(chain.sum.EncryptedIndex),
+				Tag:            slices.Clone(chain.sum.Tag),
+			}
+			chain.compact = true
+		}
+		return addEntry(chain.sum.EncryptedIndex, chain.sum.Tag, entry)
+	})
+	if err != nil {
+		return resolvedChain{}, err
+	}
+	return chain, nil
+}
+
+// walkChain calls fn with the key and entry of every chain entry, newest
+// first, and an empty entry where the chain is missing. Since chains are
+// built from client tokens, a walk that comes back to an entry is an error
+// rather than a way to loop up to UpdateCount times.
+func (s *Server) walkChain(ctx context.Context, get GetFunc, tok searchToken, fn func(iutok []byte, entry Entry) error) error {
+	updateKeyH1 := deriveKey(tok.UpdateKey, "h1")
+	updateKeyH2 := deriveKey(tok.UpdateKey, "h2")
+	h1, err := blake3.NewKeyed(updateKeyH1)
+	if err != nil {
+		return fmt.Errorf("failed to initialize h1: %w", err)
+	}
+	h2, err := blake3.NewKeyed(updateKeyH2)
+	if err != nil {
+		return fmt.Errorf("failed to initialize h2: %w", err)
+	}
+	seen := make(map[string]bool)
+	istok := slices.Clone(tok.InternalSearchToken)
+	for count := tok.UpdateCount; count >= 0; count-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		iutok := h1.Sum(istok)
+		if seen[string(iutok)] {
+			return fmt.Errorf("%w: loops back to an earlier entry", ErrCorruptChain)
+		}
+		seen[string(iutok)] = true
+		entry, _, err := get(iutok)
+		if err != nil {
+			return fmt.Errorf("failed to read chain entry: %w", err)
+		}
+		if err := fn(iutok, entry); err != nil {
+			return err
 		}
+		if entry.MaskedInternalSearchToken == nil {
+			break
+		}
+		if len(entry.MaskedInternalSearchToken) != len(istok) {
+			return fmt.Errorf("%w: malformed entry", ErrCorruptChain)
+		}
+		subtle.XORBytes(istok, entry.MaskedInternalSearchToken, h2.Sum(istok))
+		h1.Reset()
+		h2.Reset()
 	}
 	return nil
 }
 
+// ResolveUpdates stores chain entries of the current key epoch, or of the
+// next one while the index is being re-keyed.
+func (s *Server) ResolveUpdates(tokens ...sse.UpdateToken) error {
+	return s.ResolveUpdatesContext(context.Background(), tokens...)
+}
+
+func (s *Server) ResolveUpdatesContext(ctx context.Context, tokens ...sse.UpdateToken) error {
+	s.epochMu.RLock()
+	defer s.epochMu.RUnlock()
+	epoch, err := s.Epoch()
+	if err != nil {
+		return err
+	}
+	utoks := make([]updateToken, len(tokens))
+	for i, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		utok, err := decodeUpdateToken(token, s.config.maxUpdateTokenSize())
+		if err != nil {
+			return err
+		}
+		if err := s.checkUpdateToken(utok); err != nil {
+			return err
+		}
+		utoks[i] = utok
+		if utok.Epoch != epoch && utok.Epoch != epoch+1 {
+			return fmt.Errorf("%w: update token of epoch %d, server at epoch %d", ErrEpochMismatch, utok.Epoch, epoch)
+		}
+	}
+	return s.transact(ctx, "update", func(get GetFunc) (*Batch, error) {
+		var b Batch
+		if err := extendDeviceLogs(get, utoks, &b); err != nil {
+			return nil, err
+		}
+		for _, utok := range utoks {
+			b.Put(utok.NextInternalUpdateToken, Entry{
+				MaskedInternalSearchToken: utok.MaskedInternalSearchToken,
+				EncryptedIndex:            utok.EncryptedIndex,
+				Tag:                       utok.Tag,
+			})
+		}
+		return &b, nil
+	})
+}
+
 type searchToken struct {
+	Config              []byte
+	Epoch               uint64
+	Segment             uint64
 	UpdateCount         int64
 	InternalSearchToken []byte
 	UpdateKey           []byte
 }
 
 type searchResult struct {
+	Segments []segmentResult
+}
+
+type segmentResult struct {
+	Segment        uint64
 	EncryptedIndex []byte
 	Tag            []byte
 }
 
 type updateToken struct {
+	Config                    []byte
+	Epoch                     uint64
+	Segment                   uint64
 	NextInternalUpdateToken   []byte
 	MaskedInternalSearchToken []byte
 	EncryptedIndex            []byte
 	Tag                       []byte
+
+	// Device identifies the device that wrote the entry, whose log hash goes
+	// from Log to NextLog with the update.
+	Device  []byte
+	Log     []byte
+	NextLog []byte
+}
+
+// decodeToken decodes a client token into v, unless it is larger than max
+// bytes, since gob allocates whatever a token announces.
+func decodeToken(token []byte, max int, what string, v any) error {
+	if len(token) > max {
+		return fmt.Errorf("%w: %s too large: %d bytes", ErrMalformedToken, what, len(token))
+	}
+	dec := gob.NewDecoder(bytes.NewBuffer(token))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: failed to decode %s: %w", ErrMalformedToken, what, err)
+	}
+	return nil
+}
+
+// checkSearchChains checks the chains of a search or compaction token.
+func (s *Server) checkSearchChains(stok []searchToken) error {
+	if len(stok) > s.config.maxSearchChains() {
+		return fmt.Errorf("%w: too many chains in search token: %d", ErrMalformedToken, len(stok))
+	}
+	return s.checkSearchTokens(stok)
+}
+
+// checkSearchTokens also rejects a chain listed twice, which would be walked
+// and compacted twice.
+func (s *Server) checkSearchTokens(stok []searchToken) error {
+	type chain struct {
+		segment uint64
+		istok   string
+	}
+	seen := make(map[chain]bool, len(stok))
+	for _, tok := range stok {
+		if err := s.config.checkFingerprint("search token", tok.Config); err != nil {
+			return err
+		}
+		if len(tok.InternalSearchToken) != 32 || len(tok.UpdateKey) != 32 || tok.UpdateCount < 0 {
+			return fmt.Errorf("%w: search token", ErrMalformedToken)
+		}
+		c := chain{tok.Segment, string(tok.InternalSearchToken)}
+		if seen[c] {
+			return fmt.Errorf("%w: chain listed twice in segment %d", ErrMalformedToken, tok.Segment)
+		}
+		seen[c] = true
+	}
+	return s.checkEpoch(stok)
+}
+
+// internalUpdateTokenSize is the length of the store key of a chain entry,
+// which keeps them apart from the keys of server metadata. Keys are computed
+// with h1.Sum, which appends the 32-byte hash to the 32-byte internal search
+// token it is given.
+const internalUpdateTokenSize = 64
+
+// checkUpdateToken makes sure that an entry fits the index of its segment
+// before it is stored, since a misfit would only surface when searched.
+func (s *Server) checkUpdateToken(utok updateToken) error {
+	if err := s.config.checkFingerprint("update token", utok.Config); err != nil {
+		return err
+	}
+	seg, ok := s.config.segment(utok.Segment)
+	if !ok {
+		return &ConfigMismatchError{Object: "update token", Reason: fmt.Sprintf("unknown segment %d", utok.Segment)}
+	}
+	if err := s.config.checkIndexLength("update token", seg, utok.EncryptedIndex); err != nil {
+		return err
+	}
+	if len(utok.Tag) != ahmac.Size || len(utok.NextInternalUpdateToken) != internalUpdateTokenSize ||
+		(utok.MaskedInternalSearchToken != nil && len(utok.MaskedInternalSearchToken) != 32) ||
+		len(utok.Device) != 32 || len(utok.NextLog) != 32 || (utok.Log != nil && len(utok.Log) != 32) {
+		return fmt.Errorf("%w: update token", ErrMalformedToken)
+	}
+	return nil
 }
@@ -2,11 +2,15 @@ package emys_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"os"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
 
 	"interrato.dev/emys/internal/emys"
@@ -364,3 +368,616 @@ func BenchmarkUpdate(b *testing.B) {
 		}
 	}
 }
+
+func TestGrow(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          2,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(text string) []uint64 {
+		stok, err := client.Search(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(text, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	utoks, err := client.Update(
+		sse.Change[uint64]{FileID: 0, Diff: emys.Diff(nil, []byte("Hello, Gopher!"))},
+		sse.Change[uint64]{FileID: 1, Diff: emys.Diff(nil, []byte("Hello, 世界"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("Gopher"); !slices.Equal(got, []uint64{0}) {
+		t.Errorf("got %v, want [0]", got)
+	}
+
+	if _, err := client.Update(sse.Change[uint64]{FileID: 2, Diff: emys.Diff(nil, []byte("Gopher"))}); err == nil {
+		t.Fatal("update beyond capacity was accepted")
+	}
+	grown, err := client.Grow(300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server grows while it resolves searches, which it rejects once
+	// their config is outdated.
+	stok, err := client.Search("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			_, err := server.ResolveSearch(stok)
+			if err != nil && !errors.As(err, new(*emys.ConfigMismatchError)) {
+				t.Error(err)
+			}
+		})
+	}
+	if err := server.Grow(300); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if _, err := client.Grow(300); err == nil {
+		t.Error("shrinking capacity was accepted")
+	}
+
+	utoks, err = client.Update(
+		sse.Change[uint64]{FileID: 299, Diff: emys.Diff(nil, []byte("Gopher"))},
+		sse.Change[uint64]{FileID: 1, Diff: emys.Diff([]byte("Hello, 世界"), []byte("Hello, Gopher"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("Gopher"); !slices.Equal(got, []uint64{0, 1, 299}) {
+		t.Errorf("got %v, want [0 1 299]", got)
+	}
+	if got := search("Hello"); !slices.Equal(got, []uint64{0, 1}) {
+		t.Errorf("got %v, want [0 1]", got)
+	}
+
+	state, err := client.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadState(state); err == nil {
+		t.Error("state of a grown client loaded with the original config")
+	}
+	client, err = emys.NewClient(key, nonce, grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("Gopher"); !slices.Equal(got, []uint64{0, 1, 299}) {
+		t.Errorf("got %v after reloading state, want [0 1 299]", got)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          1000,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+		SegmentFiles:      128,
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(query *emys.Query) []uint64 {
+		stok, err := client.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(query, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	utoks, err := client.Update(sse.Change[uint64]{FileID: 150, Diff: emys.Diff(nil, []byte("Gopher"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utoks) != 4 {
+		t.Errorf("got %d update tokens, want 4", len(utoks))
+	}
+	for _, utok := range utoks {
+		// The whole index of 1000 four-bit counters takes 16 blocks.
+		if len(utok) >= 16*33 {
+			t.Errorf("update token carries more than one segment: %d bytes", len(utok))
+		}
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	utoks, err = client.Update(
+		sse.Change[uint64]{FileID: 3, Diff: emys.Diff(nil, []byte("Gopher"))},
+		sse.Change[uint64]{FileID: 999, Diff: emys.Diff(nil, []byte("Gopher"))},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utoks) != 8 {
+		t.Errorf("got %d update tokens, want 8", len(utoks))
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := search(&emys.Query{Text: "Gopher"}); !slices.Equal(got, []uint64{3, 150, 999}) {
+		t.Errorf("got %v, want [3 150 999]", got)
+	}
+	query := &emys.Query{Text: "Gopher", Range: &emys.FileRange{From: 100, To: 200}}
+	if got := search(query); !slices.Equal(got, []uint64{150}) {
+		t.Errorf("got %v, want [150]", got)
+	}
+	query = &emys.Query{Text: "Gopher", Range: &emys.FileRange{From: 200, To: 900}}
+	if got := search(query); len(got) != 0 {
+		t.Errorf("got %v, want no results", got)
+	}
+}
+
+func TestCounterWidths(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	for _, tt := range []struct {
+		maxSearchTrigrams uint16
+		counterBits       uint8
+	}{
+		{maxSearchTrigrams: 40},
+		{maxSearchTrigrams: 10, counterBits: 5},
+		{maxSearchTrigrams: 4, counterBits: 40},
+		{maxSearchTrigrams: 1000, counterBits: 64},
+	} {
+		config := &emys.Config{
+			MaxFiles:          100,
+			MaxSearchTrigrams: tt.maxSearchTrigrams,
+			SearchThreshold:   0.75,
+			CounterBits:       tt.counterBits,
+		}
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utoks, err := client.Update(
+			sse.Change[uint64]{FileID: 41, Diff: emys.Diff(nil, []byte("Hello, Gopher!"))},
+			sse.Change[uint64]{FileID: 42, Diff: emys.Diff(nil, []byte("Hello, 世界"))},
+			sse.Change[uint64]{FileID: 99, Diff: emys.Diff(nil, []byte("Gopher"))},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		query := &emys.Query{Text: "Gopher"}
+		stok, err := client.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(query, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, []uint64{41, 99}) {
+			t.Errorf("%+v: got %v, want [41 99]", tt, ids)
+		}
+	}
+
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 40,
+		SearchThreshold:   0.75,
+		CounterBits:       5,
+	}
+	if _, err := emys.NewClient(key, nonce, config); err == nil {
+		t.Errorf("counter width too small for MaxSearchTrigrams was accepted")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	var changes []sse.Change[uint64]
+	var queries []string
+	for id := range uint64(20) {
+		text := generateFile(30)
+		changes = append(changes, sse.Change[uint64]{
+			FileID: id,
+			Diff:   emys.Diff(nil, []byte(text)),
+		})
+		queries = append(queries, text[:12])
+	}
+
+	var want [][]uint64
+	for _, workers := range []int{0, 1, 4, 16} {
+		config := &emys.Config{
+			MaxFiles:          1000,
+			MaxSearchTrigrams: 20,
+			SearchThreshold:   0.75,
+			SegmentFiles:      256,
+			Workers:           workers,
+		}
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utoks, err := client.Update(changes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		var got [][]uint64
+		for _, q := range queries {
+			stok, err := client.Search(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := server.ResolveSearch(stok)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids, err := client.OpenResult(q, result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ids)
+		}
+		for id, ids := range got {
+			if !slices.Contains(ids, uint64(id)) {
+				t.Errorf("workers=%d: file %d not found: %v", workers, id, ids)
+			}
+		}
+		if want == nil {
+			want = got
+		} else if !slices.EqualFunc(got, want, slices.Equal) {
+			t.Errorf("workers=%d: got %v, want %v", workers, got, want)
+		}
+	}
+}
+
+func BenchmarkBulkUpdate(b *testing.B) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("USER FOR BENCHMARKS ONLY")
+	var changes []sse.Change[uint64]
+	for id := range uint64(20) {
+		changes = append(changes, sse.Change[uint64]{
+			FileID: id,
+			Diff:   emys.Diff(nil, []byte(generateFile(20))),
+		})
+	}
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			config := &emys.Config{
+				MaxFiles:          10_000,
+				MaxSearchTrigrams: 15,
+				SearchThreshold:   0.75,
+				Workers:           workers,
+			}
+			for b.Loop() {
+				client, err := emys.NewClient(key, nonce, config)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := client.Update(changes...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenResultMemory(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          500_000,
+		MaxSearchTrigrams: 3,
+		SearchThreshold:   1,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: 123_456, Diff: emys.Diff(nil, []byte("Gopher"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		utoks, err = client.Update(sse.Change[uint64]{FileID: 123_456, Diff: emys.Diff([]byte("Gopher"), nil)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	utoks, err := client.Update(sse.Change[uint64]{FileID: 123_456, Diff: emys.Diff(nil, []byte("Gopher"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	query := "Gop"
+	stok, err := client.Search(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ids, err := client.OpenResult(query, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if !slices.Equal(ids, []uint64{123_456}) {
+		t.Errorf("got %v, want [123456]", ids)
+	}
+	// Decoding the result takes about twice its size, while the keys of all
+	// seven chain entries are applied in place.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4*uint64(len(result)) {
+		t.Errorf("OpenResult allocated %d bytes for a %d bytes result", alloc, len(result))
+	}
+}
+
+func TestDerivedSearchTokens(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	var changes []sse.Change[uint64]
+	for id := range uint64(30) {
+		changes = append(changes, sse.Change[uint64]{
+			FileID: id,
+			Diff:   emys.Diff(nil, []byte(generateFile(30))),
+		})
+	}
+	changes = append(changes, sse.Change[uint64]{
+		FileID: 30,
+		Diff:   emys.Diff(nil, []byte("Hello, Gopher!")),
+	})
+
+	var sizes []int
+	for _, derived := range []bool{false, true} {
+		config := &emys.Config{
+			MaxFiles:            100,
+			MaxSearchTrigrams:   10,
+			SearchThreshold:     0.75,
+			DerivedSearchTokens: derived,
+		}
+		other := *config
+		other.DerivedSearchTokens = !derived
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utoks, err := client.Update(changes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		state, err := client.State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(state))
+
+		// Chains started in one mode carry on in the other.
+		switched, err := emys.NewClient(key, nonce, &other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := switched.LoadState(state); err != nil {
+			t.Fatal(err)
+		}
+		utoks, err = switched.Update(sse.Change[uint64]{FileID: 31, Diff: emys.Diff(nil, []byte("Gophers"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		stok, err := switched.Search("Gopher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := switched.OpenResult("Gopher", result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(ids, 30) || !slices.Contains(ids, 31) {
+			t.Errorf("derived=%v: got %v, want 30 and 31", derived, ids)
+		}
+	}
+	if sizes[1] > sizes[0]/2 {
+		t.Errorf("derived tokens state is %d bytes, random tokens state %d", sizes[1], sizes[0])
+	}
+}
+
+// cancellingStore cancels a context the first time an entry is read.
+type cancellingStore struct {
+	*emys.MemoryStore
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) Get(key []byte) (emys.Entry, bool, error) {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	return s.MemoryStore.Get(key)
+}
+
+func TestContext(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+		SegmentFiles:      32,
+		Workers:           2,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &cancellingStore{MemoryStore: emys.NewMemoryStore()}
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := emys.NewDocuments[string](client)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	countKeys := func() int {
+		n := 0
+		store.Keys(func([]byte) error { n++; return nil })
+		return n
+	}
+	update := func(id string, text string) {
+		utoks, err := docs.Update(sse.Change[string]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update("a", "hello world")
+	update("b", "hello there")
+	if _, err := docs.UpdateContext(cancelled, sse.Change[string]{FileID: "c", Diff: emys.Diff(nil, []byte("hello again"))}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled update: got %v", err)
+	}
+	if _, ok := docs.Slot("c"); ok {
+		t.Error("cancelled update assigned a slot")
+	}
+	utoks, err := docs.Update(sse.Change[string]{FileID: "c", Diff: emys.Diff(nil, []byte("say hello"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdatesContext(cancelled, utoks...); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled resolution of updates: got %v", err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if slot, _ := docs.Slot("c"); slot != 2 {
+		t.Errorf("slot of c: got %d, want 2", slot)
+	}
+
+	// The context is cancelled while the server walks the chains, which must
+	// then be left uncompacted.
+	stok, err := docs.Search("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := countKeys()
+	ctx, cancel := context.WithCancel(context.Background())
+	store.cancel = cancel
+	if _, err := server.ResolveSearchContext(ctx, stok); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled search: got %v", err)
+	}
+	if after := countKeys(); after != before {
+		t.Errorf("cancelled search changed the store: %d entries, want %d", after, before)
+	}
+	res, err := server.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countKeys() >= before {
+		t.Error("search did not compact the chains")
+	}
+	if _, err := docs.OpenResultContext(cancelled, "hello", res); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled opening of result: got %v", err)
+	}
+	ids, err := docs.OpenResult("hello", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
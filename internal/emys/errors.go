@@ -0,0 +1,149 @@
+package emys
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrQueryTooShort is returned, as a *QueryError, for queries of fewer than
+// three characters, which have no trigram to search for.
+var ErrQueryTooShort = errors.New("query too short")
+
+// ErrQueryTooLong is returned, as a *QueryError, for queries with more known
+// trigrams than Config.MaxSearchTrigrams. Client.Search also wraps it when
+// the chains of all devices add up to more than the server accepts.
+var ErrQueryTooLong = errors.New("query too long")
+
+// ErrFileIDOutOfRange is returned, as a *FileIDError, for file identifiers
+// beyond the capacity of the index.
+var ErrFileIDOutOfRange = errors.New("file identifier out of range")
+
+// ErrInvalidTag is returned, within a *SegmentError, when the index of a
+// segment in a search result fails authentication. The server either lost
+// or altered chain entries, or accepted them from the holder of a delegated
+// capability, so asking it again will not help.
+var ErrInvalidTag = errors.New("invalid tag")
+
+// ErrMalformedResult is returned for results that do not answer the token
+// they were resolved from, such as those missing a segment.
+var ErrMalformedResult = errors.New("malformed result")
+
+// ErrMalformedToken is returned by Server methods for tokens that cannot be
+// decoded or that could not have been produced by a client.
+var ErrMalformedToken = errors.New("malformed token")
+
+// ErrCorruptChain is returned, within a *ChainError, when the entries of a
+// chain on the server do not link up.
+var ErrCorruptChain = errors.New("corrupt chain")
+
+// ErrKeyRotated is returned by a client that was replaced by Rotate.
+var ErrKeyRotated = errors.New("client key was rotated")
+
+// ErrNotRotated is returned by Client.CutOver for a client that Rotate did
+// not replace.
+var ErrNotRotated = errors.New("client key was not rotated")
+
+// ErrRotationWithDevices is returned by Client.Rotate when other devices
+// share the index, since their chains would not be re-keyed.
+var ErrRotationWithDevices = errors.New("key rotation with several devices is not supported")
+
+// ErrEpochMismatch is returned by the server when a token was built under a
+// key epoch other than the current one, such as a search with a retired key.
+var ErrEpochMismatch = errors.New("key epoch mismatch")
+
+// ErrStaleBackup is returned by Server.ResolveBackup when the backup was not
+// made from the latest stored version, typically by a device that missed the
+// backups of another one. The device should restore the latest backup before
+// trying again.
+var ErrStaleBackup = errors.New("stale backup")
+
+// ErrNoBackup is returned by Server.Backup when no backup was ever stored.
+var ErrNoBackup = errors.New("no backup stored")
+
+// ErrDeviceForked is returned by Client.Merge when two states of the same
+// device both hold updates the other lacks, and by Server.ResolveUpdates when
+// an update does not follow the last one of its device, as happens when a
+// device state is copied to another device instead of giving it an identifier
+// of its own.
+var ErrDeviceForked = errors.New("device forked")
+
+// ErrNarrowCounters is returned by Client.Check for one-bit counters, since a
+// negative counter then borrows from the next one and reads like a positive
+// one.
+var ErrNarrowCounters = errors.New("counters too narrow to check")
+
+// ErrFileCacheDisabled is returned by operations that need the file cache.
+var ErrFileCacheDisabled = errors.New("file cache not enabled")
+
+// ErrUnknownDocument is returned by Documents for identifiers it never saw.
+var ErrUnknownDocument = errors.New("unknown document")
+
+// ErrUnknownTrigram is returned by Client.Compact for trigrams no device has
+// a chain for.
+var ErrUnknownTrigram = errors.New("unknown trigram")
+
+// QueryError reports a query the config does not allow. It unwraps to
+// ErrQueryTooShort or ErrQueryTooLong.
+type QueryError struct {
+	Err         error
+	Characters  int // set for ErrQueryTooShort
+	Trigrams    int // known trigrams, set for ErrQueryTooLong
+	MaxTrigrams int
+}
+
+func (e *QueryError) Error() string {
+	if e.Err == ErrQueryTooShort {
+		return fmt.Sprintf("%v: %d characters", e.Err, e.Characters)
+	}
+	return fmt.Sprintf("%v: %d trigrams, at most %d", e.Err, e.Trigrams, e.MaxTrigrams)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// FileIDError reports a file identifier not below Config.MaxFiles.
+type FileIDError struct {
+	FileID   uint64
+	MaxFiles uint64
+}
+
+func (e *FileIDError) Error() string {
+	return fmt.Sprintf("%v: %d, capacity %d", ErrFileIDOutOfRange, e.FileID, e.MaxFiles)
+}
+
+func (e *FileIDError) Unwrap() error {
+	return ErrFileIDOutOfRange
+}
+
+// SegmentError reports a segment of a search result that could not be
+// opened, along with the trigrams whose chains it sums.
+type SegmentError struct {
+	Segment  uint64
+	Trigrams []string
+	Err      error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("segment %d: %v", e.Segment, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// ChainError reports a chain that the server failed to walk. Chain is its
+// position in the token, since the server cannot tell which trigram it is.
+type ChainError struct {
+	Chain   int
+	Segment uint64
+	Err     error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("chain %d in segment %d: %v", e.Chain, e.Segment, e.Err)
+}
+
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
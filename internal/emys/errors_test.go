@@ -0,0 +1,145 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestErrors(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 3,
+		SearchThreshold:   0.75,
+		SegmentFiles:      32,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := emys.NewMemoryStore()
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queryErr *emys.QueryError
+	_, err = client.Search("hi")
+	if !errors.Is(err, emys.ErrQueryTooShort) || !errors.As(err, &queryErr) || queryErr.Characters != 2 {
+		t.Errorf("short query: got %v", err)
+	}
+	utoks, err := client.Update(sse.Change[uint64]{FileID: 0, Diff: emys.Diff(nil, []byte("hello world"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Search("hello world")
+	if !errors.Is(err, emys.ErrQueryTooLong) || !errors.As(err, &queryErr) || queryErr.Trigrams != 9 || queryErr.MaxTrigrams != 3 {
+		t.Errorf("long query: got %v", err)
+	}
+
+	var fileErr *emys.FileIDError
+	_, err = client.Update(sse.Change[uint64]{FileID: 70, Diff: emys.Diff(nil, []byte("hello"))})
+	if !errors.Is(err, emys.ErrFileIDOutOfRange) || !errors.As(err, &fileErr) || fileErr.FileID != 70 || fileErr.MaxFiles != 70 {
+		t.Errorf("file identifier out of range: got %v", err)
+	}
+
+	// The server misses an update, which starts a chain in the second
+	// segment, and then cannot walk that chain.
+	if _, err := client.Update(sse.Change[uint64]{FileID: 40, Diff: emys.Diff(nil, []byte("hello"))}); err != nil {
+		t.Fatal(err)
+	}
+	stok, err := client.Search("hel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chainErr *emys.ChainError
+	_, err = server.ResolveSearch(stok)
+	if !errors.Is(err, emys.ErrCorruptChain) || !errors.As(err, &chainErr) || chainErr.Segment != 32 {
+		t.Errorf("missed update: got %v", err)
+	}
+
+	// The tags of the entries in the store are altered, so that the index
+	// fails to verify.
+	stok, err = client.Search("wor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Keys(func(key []byte) error {
+		entry, _, err := store.Get(key)
+		if err != nil || len(entry.Tag) == 0 {
+			return err
+		}
+		entry.Tag = slices.Clone(entry.Tag)
+		entry.Tag[len(entry.Tag)-1] ^= 1
+		return store.Put(key, entry)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segErr *emys.SegmentError
+	_, err = client.OpenResult("wor", res)
+	if !errors.Is(err, emys.ErrInvalidTag) || !errors.As(err, &segErr) || segErr.Segment != 0 || !slices.Equal(segErr.Trigrams, []string{"wor"}) {
+		t.Errorf("altered tags: got %v", err)
+	}
+	if _, err := client.OpenResult("hel", []byte("garbage")); !errors.Is(err, emys.ErrMalformedResult) {
+		t.Errorf("garbage result: got %v", err)
+	}
+
+	if _, err := server.ResolveSearch([]byte("garbage")); !errors.Is(err, emys.ErrMalformedToken) {
+		t.Errorf("garbage search token: got %v", err)
+	}
+	if err := server.ResolveUpdates([]byte("garbage")); !errors.Is(err, emys.ErrMalformedToken) {
+		t.Errorf("garbage update token: got %v", err)
+	}
+
+	if _, err := client.SetContent(1, []byte("hello")); !errors.Is(err, emys.ErrFileCacheDisabled) {
+		t.Errorf("file cache disabled: got %v", err)
+	}
+	docs := emys.NewDocuments[string](client)
+	if _, err := docs.Delete("missing"); !errors.Is(err, emys.ErrUnknownDocument) {
+		t.Errorf("unknown document: got %v", err)
+	}
+
+	if _, err := client.CutOver(); !errors.Is(err, emys.ErrNotRotated) {
+		t.Errorf("cut-over without rotation: got %v", err)
+	}
+	phone, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := phone.SetDevice("phone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := phone.Update(sse.Change[uint64]{FileID: 2, Diff: emys.Diff(nil, []byte("hello"))}); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := phone.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ResolveBackup(backup); err != nil {
+		t.Fatal(err)
+	}
+	if backup, err = server.Backup(); err != nil {
+		t.Fatal(err)
+	}
+	client.EnableFileCache()
+	if err := client.Merge(backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Rotate([]byte("BLACK WIZARDRY, YELLOW SUBMARINE")); !errors.Is(err, emys.ErrRotationWithDevices) {
+		t.Errorf("rotation with several devices: got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package emys
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
+	"interrato.dev/emys/internal/sse"
+)
+
+const fileCacheKeyLabel = "file cache encryption"
+
+// EnableFileCache makes the client keep track of the trigrams currently
+// indexed for each file. Updates are then checked against the cache, so that
+// a trigram can't be inserted twice or removed while absent, and files can be
+// changed or deleted without providing their old content.
+func (c *Client) EnableFileCache() {
+	if c.files == nil {
+		c.files = make(map[uint64][]string)
+	}
+}
+
+func (c *Client) FileCache() ([]byte, error) {
+	if c.files == nil {
+		return nil, ErrFileCacheDisabled
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(c.files); err != nil {
+		return nil, fmt.Errorf("failed to encode file cache: %w", err)
+	}
+	return c.seal(fileCacheKeyLabel, "file cache dump", buf.Bytes())
+}
+
+func (c *Client) LoadFileCache(cache []byte) error {
+	plaintext, err := c.open(fileCacheKeyLabel, "file cache dump", cache)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file cache: %w", err)
+	}
+	files := make(map[uint64][]string)
+	dec := gob.NewDecoder(bytes.NewBuffer(plaintext))
+	if err := dec.Decode(&files); err != nil {
+		return fmt.Errorf("failed to decode file cache: %w", err)
+	}
+	c.files = files
+	return nil
+}
+
+func (c *Client) SetContent(fileID uint64, content []byte) ([]sse.UpdateToken, error) {
+	if c.files == nil {
+		return nil, ErrFileCacheDisabled
+	}
+	var next []string
+	if utf8.RuneCount(content) >= 3 {
+		next = trigrams(string(content))
+	}
+	diff := diffTrigrams(c.files[fileID], next)
+	return c.Update(sse.Change[uint64]{FileID: fileID, Diff: diff})
+}
+
+func (c *Client) DeleteFile(fileID uint64) ([]sse.UpdateToken, error) {
+	return c.SetContent(fileID, nil)
+}
+
+// stageFileChange applies a parsed diff to the staged trigram set of a file,
+// which starts as a copy of the cached one. Sets are kept sorted.
+func (c *Client) stageFileChange(staged map[uint64][]string, fileID uint64, removed, inserted []string) error {
+	set, ok := staged[fileID]
+	if !ok {
+		set = slices.Clone(c.files[fileID])
+	}
+	for _, trigram := range removed {
+		i, found := slices.BinarySearch(set, trigram)
+		if !found {
+			return fmt.Errorf("trigram %q not indexed for file %d", trigram, fileID)
+		}
+		set = slices.Delete(set, i, i+1)
+	}
+	for _, trigram := range inserted {
+		i, found := slices.BinarySearch(set, trigram)
+		if found {
+			return fmt.Errorf("trigram %q already indexed for file %d", trigram, fileID)
+		}
+		set = slices.Insert(set, i, trigram)
+	}
+	staged[fileID] = set
+	return nil
+}
+
+func (c *Client) commitFileChanges(staged map[uint64][]string) {
+	for fileID, set := range staged {
+		if len(set) == 0 {
+			delete(c.files, fileID)
+		} else {
+			c.files[fileID] = set
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package emys_test
+
+import (
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestFileCache(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          10,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableFileCache()
+
+	search := func(text string) []uint64 {
+		stok, err := client.Search(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(text, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	resolve := func(utoks []sse.UpdateToken, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve(client.SetContent(0, []byte("Hello, Gopher!")))
+	resolve(client.SetContent(1, []byte("Hello, 世界")))
+	resolve(client.SetContent(0, []byte("Have fun, Gopher!")))
+	if ids := search("hello"); !slices.Equal(ids, []uint64{1}) {
+		t.Errorf("got %v, want [1]", ids)
+	}
+	if ids := search("Gopher"); !slices.Equal(ids, []uint64{0}) {
+		t.Errorf("got %v, want [0]", ids)
+	}
+
+	cache, err := client.FileCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := client.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.LoadFileCache(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve(client.DeleteFile(1))
+	if ids := search("hello"); len(ids) != 0 {
+		t.Errorf("got %v, want no results", ids)
+	}
+
+	double := sse.Change[uint64]{FileID: 0, Diff: emys.Diff(nil, []byte("Gopher"))}
+	if _, err := client.Update(double); err == nil {
+		t.Errorf("double insert was accepted")
+	}
+	absent := sse.Change[uint64]{FileID: 1, Diff: emys.Diff([]byte("Hello"), nil)}
+	if _, err := client.Update(absent); err == nil {
+		t.Errorf("removal of absent trigrams was accepted")
+	}
+
+	ctok, err := client.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.ResolveCheck(ctok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.OpenCheck(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("unexpected faults: %+v", report)
+	}
+}
@@ -0,0 +1,404 @@
+package emys_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"unicode/utf8"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+// fuzzIndex holds a small index and a valid instance of every token, result
+// and state blob, used as seeds.
+type fuzzIndex struct {
+	key, nonce []byte
+	config     *emys.Config
+	client     *emys.Client
+	server     *emys.Server
+	snapshot   []byte
+
+	updates    []sse.UpdateToken
+	search     sse.SearchToken
+	result     sse.SearchResult
+	check      sse.SearchToken
+	checkRes   sse.SearchResult
+	compact    sse.SearchToken
+	backup     []byte
+	stored     []byte
+	cutOver    sse.SearchToken
+	capability []byte
+	state      []byte
+	fileCache  []byte
+}
+
+func newFuzzIndex(tb testing.TB) *fuzzIndex {
+	x := &fuzzIndex{
+		key:   []byte("YELLOW SUBMARINE, BLACK WIZARDRY"),
+		nonce: []byte("THIS USER IS FOR TESTING"),
+		config: &emys.Config{
+			MaxFiles:          70,
+			MaxSearchTrigrams: 10,
+			SearchThreshold:   0.75,
+			SegmentFiles:      32,
+		},
+	}
+	var err error
+	must := func(err error) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	x.client, err = emys.NewClient(x.key, x.nonce, x.config)
+	must(err)
+	x.client.EnableFileCache()
+	x.server, err = emys.NewServer(x.config)
+	must(err)
+	for i, text := range []string{"hello world", "hello there", "goodbye world"} {
+		utoks, err := x.client.SetContent(uint64(i*30), []byte(text))
+		must(err)
+		must(x.server.ResolveUpdates(utoks...))
+		x.updates = append(x.updates, utoks...)
+	}
+	x.search, err = x.client.Search("hello")
+	must(err)
+	x.result, err = x.server.ResolveSearch(x.search)
+	must(err)
+	x.check, err = x.client.Check()
+	must(err)
+	x.checkRes, err = x.server.ResolveCheck(x.check)
+	must(err)
+	x.compact, err = x.client.Compact("wor")
+	must(err)
+	x.backup, err = x.client.Backup()
+	must(err)
+	res, err := x.server.ResolveBackup(x.backup)
+	must(err)
+	must(x.client.OpenBackupResult(res))
+	x.stored, err = x.server.Backup()
+	must(err)
+	x.capability, err = x.client.DelegateSearch()
+	must(err)
+	x.state, err = x.client.State()
+	must(err)
+	x.fileCache, err = x.client.FileCache()
+	must(err)
+	x.snapshot, err = x.server.State()
+	must(err)
+
+	retired, err := emys.NewClient(x.key, x.nonce, x.config)
+	must(err)
+	must(retired.LoadState(x.state))
+	must(retired.LoadFileCache(x.fileCache))
+	_, _, err = retired.Rotate([]byte("PURPLE SUBMARINE, WHITE WIZARDRY"))
+	must(err)
+	x.cutOver, err = retired.CutOver()
+	must(err)
+	return x
+}
+
+// freshServer returns a server holding the index, so that the changes made
+// by one input don't leak into the next.
+func (x *fuzzIndex) freshServer(t *testing.T) *emys.Server {
+	server, err := emys.NewServer(x.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.LoadState(x.snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func (x *fuzzIndex) freshClient(t *testing.T) *emys.Client {
+	client, err := emys.NewClient(x.key, x.nonce, x.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func FuzzResolveSearch(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add([]byte(x.search))
+	f.Add([]byte(x.compact))
+	f.Fuzz(func(t *testing.T, token []byte) {
+		server := x.freshServer(t)
+		server.ResolveSearch(token)
+		server.ResolveCompact(token)
+	})
+}
+
+func FuzzResolveCheck(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add([]byte(x.check))
+	f.Fuzz(func(t *testing.T, token []byte) {
+		x.freshServer(t).ResolveCheck(token)
+	})
+}
+
+func FuzzResolveUpdates(f *testing.F) {
+	x := newFuzzIndex(f)
+	for _, utok := range x.updates {
+		f.Add([]byte(utok))
+	}
+	f.Fuzz(func(t *testing.T, token []byte) {
+		server := x.freshServer(t)
+		if server.ResolveUpdates(token) != nil {
+			return
+		}
+		// An accepted entry must not break searches.
+		server.ResolveSearch(x.search)
+		server.ResolveCheck(x.check)
+	})
+}
+
+func FuzzResolveCutOver(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add([]byte(x.cutOver))
+	f.Fuzz(func(t *testing.T, token []byte) {
+		x.freshServer(t).ResolveCutOver(token)
+	})
+}
+
+func FuzzResolveBackup(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add(x.backup)
+	f.Fuzz(func(t *testing.T, token []byte) {
+		x.freshServer(t).ResolveBackup(token)
+	})
+}
+
+func FuzzOpenResult(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add([]byte(x.result))
+	f.Fuzz(func(t *testing.T, result []byte) {
+		x.client.OpenResult("hello", result)
+	})
+}
+
+func FuzzOpenCheck(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add([]byte(x.checkRes))
+	f.Fuzz(func(t *testing.T, result []byte) {
+		x.client.OpenCheck(result)
+	})
+}
+
+func FuzzOpenBackup(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add(x.stored)
+	f.Fuzz(func(t *testing.T, backup []byte) {
+		x.freshClient(t).Restore(backup)
+		x.freshClient(t).Merge(backup)
+		x.freshClient(t).OpenBackupResult(backup)
+	})
+}
+
+func FuzzLoadState(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add(x.state)
+	f.Add(x.fileCache)
+	f.Fuzz(func(t *testing.T, state []byte) {
+		x.freshClient(t).LoadState(state)
+		x.freshClient(t).LoadFileCache(state)
+		emys.NewDocuments[string](x.freshClient(t)).LoadState(state)
+	})
+}
+
+func FuzzNewDelegatedSearcher(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add(x.capability)
+	f.Fuzz(func(t *testing.T, capability []byte) {
+		auditor, err := emys.NewDelegatedSearcher(capability)
+		if err != nil {
+			return
+		}
+		auditor.Search("hello")
+		auditor.OpenResult("hello", x.result)
+	})
+}
+
+func FuzzSearch(f *testing.F) {
+	x := newFuzzIndex(f)
+	f.Add("hello")
+	f.Add("hé")
+	f.Add("\xff\xfe\xfd")
+	f.Fuzz(func(t *testing.T, text string) {
+		x.client.Search(&emys.Query{Text: text})
+		emys.Diff(nil, []byte(text))
+	})
+}
+
+func FuzzParseDiff(f *testing.F) {
+	f.Add(emys.Diff([]byte("hello world"), []byte("goodbye world")))
+	f.Add([]byte("+h\xffl"))
+	f.Fuzz(func(t *testing.T, diff []byte) {
+		removed, inserted, err := emys.ParseDiff(diff)
+		if err != nil {
+			return
+		}
+		for _, trigram := range append(removed, inserted...) {
+			if !utf8.ValidString(trigram) || utf8.RuneCountInString(trigram) != 3 {
+				t.Errorf("ParseDiff(%q) returned trigram %q", diff, trigram)
+			}
+		}
+	})
+}
+
+// searchToken and updateToken mirror the fields of the wire types, in order,
+// which is all encodeWire needs to encode tampered tokens.
+type searchToken struct {
+	Config              []byte
+	Epoch               uint64
+	Segment             uint64
+	UpdateCount         int64
+	InternalSearchToken []byte
+	UpdateKey           []byte
+}
+
+type updateToken struct {
+	Config                    []byte
+	Epoch                     uint64
+	Segment                   uint64
+	NextInternalUpdateToken   []byte
+	MaskedInternalSearchToken []byte
+	EncryptedIndex            []byte
+	Tag                       []byte
+	Device                    []byte
+	Log                       []byte
+	NextLog                   []byte
+}
+
+// encodeWire follows the encoding of update and search tokens: fields in
+// declaration order, byte strings and lists prefixed by their length, and
+// integers as varints.
+func encodeWire(v any) []byte {
+	return appendWire(nil, reflect.ValueOf(v))
+}
+
+func appendWire(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Uint64:
+		return binary.AppendUvarint(b, v.Uint())
+	case reflect.Int64:
+		return binary.AppendVarint(b, v.Int())
+	case reflect.Slice:
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(b, v.Bytes()...)
+		}
+		for i := range v.Len() {
+			b = appendWire(b, v.Index(i))
+		}
+		return b
+	case reflect.Struct:
+		for i := range v.NumField() {
+			b = appendWire(b, v.Field(i))
+		}
+		return b
+	}
+	panic("unsupported type: " + v.Type().String())
+}
+
+func decodeWire(t *testing.T, b []byte, v any) {
+	t.Helper()
+	if rest := readWire(t, b, reflect.ValueOf(v).Elem()); len(rest) != 0 {
+		t.Fatalf("%d trailing bytes", len(rest))
+	}
+}
+
+func readWire(t *testing.T, b []byte, v reflect.Value) []byte {
+	t.Helper()
+	switch v.Kind() {
+	case reflect.Uint64:
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("truncated integer")
+		}
+		v.SetUint(x)
+		return b[n:]
+	case reflect.Int64:
+		x, n := binary.Varint(b)
+		if n <= 0 {
+			t.Fatal("truncated integer")
+		}
+		v.SetInt(x)
+		return b[n:]
+	case reflect.Slice:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || v.Type().Elem().Kind() == reflect.Uint8 && uint64(len(b)-n) < l {
+			t.Fatal("truncated list")
+		}
+		b = b[n:]
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if l > 0 {
+				v.SetBytes(slices.Clone(b[:l]))
+			}
+			return b[l:]
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(l), int(l)))
+		for i := range int(l) {
+			b = readWire(t, b, v.Index(i))
+		}
+		return b
+	case reflect.Struct:
+		for i := range v.NumField() {
+			b = readWire(t, b, v.Field(i))
+		}
+		return b
+	}
+	panic("unsupported type: " + v.Type().String())
+}
+
+func TestServerInputLimits(t *testing.T) {
+	x := newFuzzIndex(t)
+	malformed := func(name string, err error) {
+		t.Helper()
+		if !errors.Is(err, emys.ErrMalformedToken) {
+			t.Errorf("%s: got %v, want ErrMalformedToken", name, err)
+		}
+	}
+
+	var stok []searchToken
+	decodeWire(t, x.search, &stok)
+	duplicated := encodeWire(append(stok, stok[0]))
+	_, err := x.freshServer(t).ResolveSearch(duplicated)
+	malformed("search with a duplicate chain", err)
+	malformed("compaction with a duplicate chain", x.freshServer(t).ResolveCompact(duplicated))
+
+	// 10 trigrams in each of the 3 segments.
+	var many []searchToken
+	for i := range 31 {
+		tok := stok[0]
+		tok.InternalSearchToken = bytes.Repeat([]byte{byte(i)}, 32)
+		many = append(many, tok)
+	}
+	_, err = x.freshServer(t).ResolveSearch(encodeWire(many))
+	malformed("search with too many chains", err)
+
+	var check [][]searchToken
+	decodeWire(t, x.check, &check)
+	_, err = x.freshServer(t).ResolveCheck(encodeWire(append(check, check[0])))
+	malformed("check with a duplicate chain", err)
+	_, err = x.freshServer(t).ResolveCheck(encodeWire(make([][]searchToken, 1<<20+1)))
+	malformed("check with too many trigrams", err)
+	// The count of chains is checked before the chains are decoded.
+	_, err = x.freshServer(t).ResolveCheck(binary.AppendUvarint([]byte{1}, 1<<20))
+	malformed("check with a bogus count of chains", err)
+
+	// Tokens are rejected by size before they are decoded.
+	padding := make([]byte, 1<<20)
+	_, err = x.freshServer(t).ResolveSearch(append(x.search, padding...))
+	malformed("oversized search token", err)
+	malformed("oversized update token", x.freshServer(t).ResolveUpdates(append(x.updates[0], padding...)))
+
+	var utok updateToken
+	decodeWire(t, x.updates[0], &utok)
+	utok.NextInternalUpdateToken = utok.NextInternalUpdateToken[:32]
+	malformed("short internal update token", x.freshServer(t).ResolveUpdates(encodeWire(utok)))
+}
@@ -1,9 +1,24 @@
 package emys
 
-import "github.com/zeebo/blake3"
+import (
+	"fmt"
+
+	"github.com/zeebo/blake3"
+	"interrato.dev/emys/internal/keyfile"
+)
 
 const emysLabel = "emys-sse.org/v1"
 
+// NewClientFromKeyFile returns a client for the master key and user nonce
+// sealed in a key file.
+func NewClientFromKeyFile(data, passphrase []byte, config *Config) (*Client, error) {
+	key, userNonce, err := keyfile.Open(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	return NewClient(key, userNonce, config)
+}
+
 func deriveKey(masterKey []byte, contexts ...string) []byte {
 	if len(contexts) == 0 {
 		panic("key derivation without context string is insecure")
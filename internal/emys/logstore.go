@@ -0,0 +1,586 @@
+package emys
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LogStore keeps chain entries in an append-only file and only their location
+// in memory, so that indexes larger than RAM can be served. Every batch is
+// appended as a single checksummed record and synced before Apply returns. A
+// record torn by a crash can only be the last one, and it is dropped when the
+// file is opened. Once most of the file is garbage, it is rewritten with just
+// the live entries, while reads and writes go on.
+type LogStore struct {
+	mu    sync.RWMutex
+	path  string
+	f     *os.File
+	size  int64
+	live  int64
+	index map[string]logLocation
+
+	// compactMu is held while compacting. compactErr is the error of the
+	// last compaction, and after a failure, automatic compaction waits for
+	// the log to reach retryAt bytes.
+	compactMu  sync.Mutex
+	compactErr error
+	retryAt    int64
+}
+
+// logLocation is where the encoding of an entry lies in the file.
+type logLocation struct {
+	off int64
+	len int64
+}
+
+var _ Store = &LogStore{}
+
+const (
+	logOpPut    = 1
+	logOpDelete = 2
+
+	logHeaderSize = 8
+
+	// logMaxRecordSize bounds the payload of a record. A header announcing
+	// more cannot come from a torn write of this package, so it is
+	// reported as corruption rather than dropped with everything after it.
+	logMaxRecordSize = 1 << 30
+
+	// logCompactionThreshold is the smallest file that gets compacted
+	// automatically, so that small stores are not rewritten over and over.
+	logCompactionThreshold = 16 << 20
+
+	// logCompactionRecordSize bounds the records written by compaction, and
+	// with them the memory it needs.
+	logCompactionRecordSize = 4 << 20
+)
+
+var logChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenLogStore opens the log at path, creating it if needed, and replays it.
+func OpenLogStore(path string) (*LogStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+	l := &LogStore{
+		path:  path,
+		f:     f,
+		index: make(map[string]logLocation),
+	}
+	if err := l.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogStore) replay() error {
+	size, err := replayLog(l.f, func(off int64, payload []byte) error {
+		return l.replayRecord(payload, off+logHeaderSize)
+	})
+	if err != nil {
+		return err
+	}
+	l.size = size
+	return nil
+}
+
+// replayLog calls fn with the offset and payload of every record in f, and
+// returns the end of the last one. A crash may leave a partial record at the
+// end of the file, which was never acknowledged and is dropped.
+func replayLog(f *os.File, fn func(off int64, payload []byte) error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat log: %w", err)
+	}
+	end := info.Size()
+	off := int64(0)
+	for off < end {
+		payload, err := readLogRecord(f, off, end)
+		if errors.Is(err, errTornRecord) {
+			if err := f.Truncate(off); err != nil {
+				return 0, fmt.Errorf("failed to drop torn record: %w", err)
+			}
+			if err := f.Sync(); err != nil {
+				return 0, fmt.Errorf("failed to sync log: %w", err)
+			}
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		if err := fn(off, payload); err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		off += logHeaderSize + int64(len(payload))
+	}
+	return off, nil
+}
+
+var errTornRecord = errors.New("torn record")
+
+// readLogRecord reads the payload of the record at off. A record that is cut
+// short or fails its checksum is torn if nothing follows it, and corrupt
+// otherwise. So is one whose length is beyond what Apply writes.
+func readLogRecord(r io.ReaderAt, off, end int64) ([]byte, error) {
+	if end-off < logHeaderSize {
+		return nil, errTornRecord
+	}
+	var header [logHeaderSize]byte
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		return nil, fmt.Errorf("failed to read record header: %w", err)
+	}
+	n := int64(binary.BigEndian.Uint32(header[:4]))
+	if n > logMaxRecordSize {
+		return nil, fmt.Errorf("record length out of range: %d", n)
+	}
+	if end-off-logHeaderSize < n {
+		return nil, errTornRecord
+	}
+	payload := make([]byte, n)
+	if _, err := r.ReadAt(payload, off+logHeaderSize); err != nil {
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	if crc32.Checksum(payload, logChecksumTable) != binary.BigEndian.Uint32(header[4:]) {
+		if off+logHeaderSize+n == end {
+			return nil, errTornRecord
+		}
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// replayRecord applies to the in-memory index the operations of a record
+// whose payload starts at off.
+func (l *LogStore) replayRecord(payload []byte, off int64) error {
+	live, err := indexLogRecord(l.index, payload, off)
+	l.live += live
+	return err
+}
+
+// indexLogRecord is replayRecord for any index. It returns by how much the
+// record changed the size of the live entries.
+func indexLogRecord(index map[string]logLocation, payload []byte, off int64) (int64, error) {
+	var live int64
+	for pos := 0; pos < len(payload); {
+		op := payload[pos]
+		pos++
+		key, n, err := readLogBytes(payload[pos:])
+		if err != nil {
+			return live, fmt.Errorf("failed to read key: %w", err)
+		}
+		pos += n
+		if old, ok := index[string(key)]; ok {
+			live -= old.len
+			delete(index, string(key))
+		}
+		switch op {
+		case logOpDelete:
+		case logOpPut:
+			n, err := skipLogEntry(payload[pos:])
+			if err != nil {
+				return live, fmt.Errorf("failed to read entry: %w", err)
+			}
+			index[string(key)] = logLocation{off: off + int64(pos), len: int64(n)}
+			live += int64(n)
+			pos += n
+		default:
+			return live, fmt.Errorf("unknown operation: %d", op)
+		}
+	}
+	return live, nil
+}
+
+func appendLogBytes(b, x []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(x)))
+	return append(b, x...)
+}
+
+func readLogBytes(b []byte) ([]byte, int, error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return nil, 0, fmt.Errorf("truncated field")
+	}
+	return b[k : k+int(n)], k + int(n), nil
+}
+
+func appendLogEntry(b []byte, entry Entry) []byte {
+	b = appendLogBytes(b, entry.MaskedInternalSearchToken)
+	b = appendLogBytes(b, entry.EncryptedIndex)
+	return appendLogBytes(b, entry.Tag)
+}
+
+func skipLogEntry(b []byte) (int, error) {
+	pos := 0
+	for range 3 {
+		_, n, err := readLogBytes(b[pos:])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+func readLogEntry(b []byte) (Entry, error) {
+	var fields [3][]byte
+	pos := 0
+	for i := range fields {
+		x, n, err := readLogBytes(b[pos:])
+		if err != nil {
+			return Entry{}, err
+		}
+		if len(x) > 0 {
+			fields[i] = x
+		}
+		pos += n
+	}
+	return Entry{
+		MaskedInternalSearchToken: fields[0],
+		EncryptedIndex:            fields[1],
+		Tag:                       fields[2],
+	}, nil
+}
+
+func appendLogBatch(payload []byte, b *Batch) []byte {
+	for _, op := range b.ops {
+		if op.delete {
+			payload = append(payload, logOpDelete)
+			payload = appendLogBytes(payload, op.key)
+		} else {
+			payload = append(payload, logOpPut)
+			payload = appendLogBytes(payload, op.key)
+			payload = appendLogEntry(payload, op.entry)
+		}
+	}
+	return payload
+}
+
+func readLogBatch(payload []byte) (*Batch, error) {
+	b := new(Batch)
+	for pos := 0; pos < len(payload); {
+		op := payload[pos]
+		pos++
+		key, n, err := readLogBytes(payload[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key: %w", err)
+		}
+		pos += n
+		switch op {
+		case logOpDelete:
+			b.Delete(key)
+		case logOpPut:
+			n, err := skipLogEntry(payload[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to read entry: %w", err)
+			}
+			entry, err := readLogEntry(payload[pos : pos+n])
+			if err != nil {
+				return nil, fmt.Errorf("failed to read entry: %w", err)
+			}
+			b.Put(key, entry)
+			pos += n
+		default:
+			return nil, fmt.Errorf("unknown operation: %d", op)
+		}
+	}
+	return b, nil
+}
+
+func appendLogRecord(b, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, logChecksumTable))
+	return append(b, payload...)
+}
+
+func (l *LogStore) Get(key []byte) (Entry, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.f == nil {
+		return Entry{}, false, fmt.Errorf("log closed")
+	}
+	return l.get(key)
+}
+
+func (l *LogStore) get(key []byte) (Entry, bool, error) {
+	loc, ok := l.index[string(key)]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	b := make([]byte, loc.len)
+	if _, err := l.f.ReadAt(b, loc.off); err != nil {
+		return Entry{}, false, fmt.Errorf("failed to read entry: %w", err)
+	}
+	entry, err := readLogEntry(b)
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to decode entry: %w", err)
+	}
+	return entry, true, nil
+}
+
+func (l *LogStore) Put(key []byte, entry Entry) error {
+	var b Batch
+	b.Put(key, entry)
+	return l.Apply(&b)
+}
+
+func (l *LogStore) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return l.Apply(&b)
+}
+
+// Apply appends b to the log. Once the batch is durable, it may trigger an
+// automatic compaction, whose failure does not fail Apply, and is kept for
+// CompactionErr instead.
+func (l *LogStore) Apply(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	payload := appendLogBatch(nil, b)
+	if len(payload) > logMaxRecordSize {
+		return fmt.Errorf("batch too large: %d bytes", len(payload))
+	}
+	err := func() error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.f == nil {
+			return fmt.Errorf("log closed")
+		}
+		return l.apply(payload)
+	}()
+	if err != nil {
+		return err
+	}
+	l.autoCompact()
+	return nil
+}
+
+// Transact holds the log for writing while fn runs, so that reads and
+// batches of other goroutines wait for it.
+func (l *LogStore) Transact(fn func(get GetFunc) (*Batch, error)) error {
+	applied, err := func() (bool, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.f == nil {
+			return false, fmt.Errorf("log closed")
+		}
+		b, err := fn(l.get)
+		if err != nil {
+			return false, err
+		}
+		if b == nil || b.Len() == 0 {
+			return false, nil
+		}
+		payload := appendLogBatch(nil, b)
+		if len(payload) > logMaxRecordSize {
+			return false, fmt.Errorf("batch too large: %d bytes", len(payload))
+		}
+		return true, l.apply(payload)
+	}()
+	if applied && err == nil {
+		l.autoCompact()
+	}
+	return err
+}
+
+func (l *LogStore) apply(payload []byte) error {
+	if _, err := l.f.WriteAt(appendLogRecord(nil, payload), l.size); err != nil {
+		l.f.Truncate(l.size)
+		return fmt.Errorf("failed to append record: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Truncate(l.size)
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	if err := l.replayRecord(payload, l.size+logHeaderSize); err != nil {
+		return fmt.Errorf("failed to index record: %w", err)
+	}
+	l.size += logHeaderSize + int64(len(payload))
+	return nil
+}
+
+// autoCompact compacts the log once garbage takes up more than half of a
+// large enough log, unless a compaction is already running. After a failure,
+// it waits for the log to double in size before trying again.
+func (l *LogStore) autoCompact() {
+	l.mu.RLock()
+	due := l.size >= max(logCompactionThreshold, l.retryAt) && l.size > 2*l.live
+	l.mu.RUnlock()
+	if !due || !l.compactMu.TryLock() {
+		return
+	}
+	defer l.compactMu.Unlock()
+	l.compactAndRecord()
+}
+
+// CompactionErr returns the error of the last compaction, or nil if it
+// succeeded or none was needed yet.
+func (l *LogStore) CompactionErr() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.compactErr
+}
+
+func (l *LogStore) Keys(fn func(key []byte) error) error {
+	l.mu.RLock()
+	keys := make([]string, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+	l.mu.RUnlock()
+	for _, key := range keys {
+		if err := fn([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the live entries. It happens
+// automatically once garbage takes up more than half of a large enough log.
+func (l *LogStore) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	return l.compactAndRecord()
+}
+
+func (l *LogStore) compactAndRecord() error {
+	err := l.compact()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compactErr = err
+	l.retryAt = 0
+	if err != nil {
+		l.retryAt = 2 * l.size
+	}
+	return err
+}
+
+// compact writes the live entries to a new file without holding the lock, so
+// that reads and writes go on meanwhile. It then takes the lock to copy the
+// records appended in the meantime and to atomically rename the new file over
+// the log, so that a crash leaves either the old or the new log.
+func (l *LogStore) compact() error {
+	l.mu.RLock()
+	src, end := l.f, l.size
+	live := maps.Clone(l.index)
+	l.mu.RUnlock()
+	if src == nil {
+		return fmt.Errorf("log closed")
+	}
+	tmp := l.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted log: %w", err)
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	index := make(map[string]logLocation, len(live))
+	var size int64
+	var payload []byte
+	var pending []string
+	flush := func() error {
+		if len(payload) == 0 {
+			return nil
+		}
+		if _, err := f.Write(appendLogRecord(nil, payload)); err != nil {
+			return fmt.Errorf("failed to write compacted log: %w", err)
+		}
+		for _, key := range pending {
+			loc := index[key]
+			loc.off += size + logHeaderSize
+			index[key] = loc
+		}
+		size += logHeaderSize + int64(len(payload))
+		payload, pending = payload[:0], pending[:0]
+		return nil
+	}
+	for key, loc := range live {
+		b := make([]byte, loc.len)
+		if _, err := src.ReadAt(b, loc.off); err != nil {
+			return fmt.Errorf("failed to read entry: %w", err)
+		}
+		payload = append(payload, logOpPut)
+		payload = appendLogBytes(payload, []byte(key))
+		index[key] = logLocation{off: int64(len(payload)), len: loc.len}
+		pending = append(pending, key)
+		payload = append(payload, b...)
+		if len(payload) >= logCompactionRecordSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != src {
+		return fmt.Errorf("log closed")
+	}
+	for off := end; off < l.size; {
+		payload, err := readLogRecord(src, off, l.size)
+		if err != nil {
+			return fmt.Errorf("failed to read record at offset %d: %w", off, err)
+		}
+		if _, err := f.Write(appendLogRecord(nil, payload)); err != nil {
+			return fmt.Errorf("failed to write compacted log: %w", err)
+		}
+		if _, err := indexLogRecord(index, payload, size+logHeaderSize); err != nil {
+			return fmt.Errorf("failed to index record: %w", err)
+		}
+		size += logHeaderSize + int64(len(payload))
+		off += logHeaderSize + int64(len(payload))
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync compacted log: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("failed to replace log: %w", err)
+	}
+	// From here on, the new file is the log, even if the rename is not
+	// durable yet, so later records must go to it.
+	l.f.Close()
+	l.f, f = f, nil
+	l.index = index
+	l.size = size
+	return syncDir(filepath.Dir(l.path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+func (l *LogStore) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,232 @@
+package emys_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+)
+
+func TestLogStoreRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	store, err := emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Put([]byte(key), emys.Entry{Tag: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	intact, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any prefix of the last record is a torn write, which must be dropped
+	// together with the put it carried.
+	last := len(intact) - 1
+	for last > 0 && intact[last] != 'c' {
+		last--
+	}
+	for cut := len(intact) - 1; cut > last-12; cut-- {
+		if err := os.WriteFile(path, intact[:cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		store, err := emys.OpenLogStore(path)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		if _, ok, _ := store.Get([]byte("b")); !ok {
+			t.Errorf("cut at %d: lost an acknowledged entry", cut)
+		}
+		if _, ok, _ := store.Get([]byte("c")); ok {
+			t.Errorf("cut at %d: kept a torn entry", cut)
+		}
+		if err := store.Put([]byte("d"), emys.Entry{Tag: []byte("d")}); err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+		store, err = emys.OpenLogStore(path)
+		if err != nil {
+			t.Fatalf("cut at %d, after append: %v", cut, err)
+		}
+		if _, ok, _ := store.Get([]byte("d")); !ok {
+			t.Errorf("cut at %d: lost the entry appended after recovery", cut)
+		}
+		store.Close()
+	}
+
+	// A damaged record followed by more records is corruption, not a tear.
+	corrupt := append([]byte(nil), intact...)
+	corrupt[10] ^= 0xff
+	if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emys.OpenLogStore(path); err == nil {
+		t.Error("corrupt log was opened")
+	}
+
+	// So is a length no record can have, which would otherwise make every
+	// record after it look torn.
+	corrupt = append([]byte(nil), intact...)
+	corrupt[0] = 0xff
+	if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emys.OpenLogStore(path); err == nil {
+		t.Error("log with an out of range record length was opened")
+	}
+	if got, err := os.ReadFile(path); err != nil || len(got) != len(intact) {
+		t.Errorf("log with an out of range record length was truncated to %d bytes", len(got))
+	}
+}
+
+func TestLogStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	store, err := emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := make([]byte, 1000)
+	for i := range 100 {
+		if err := store.Put([]byte{byte(i % 10)}, emys.Entry{EncryptedIndex: index, Tag: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() > before.Size()/5 {
+		t.Errorf("compaction shrank the log from %d to %d bytes only", before.Size(), after.Size())
+	}
+	if err := store.Put([]byte("x"), emys.Entry{Tag: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := range 10 {
+		entry, ok, err := store.Get([]byte{byte(i)})
+		if err != nil || !ok {
+			t.Fatalf("Get(%d) = %v, %v", i, ok, err)
+		}
+		if len(entry.EncryptedIndex) != len(index) || entry.Tag[0] != byte(90+i) {
+			t.Errorf("Get(%d) returned a stale entry: tag %v", i, entry.Tag)
+		}
+	}
+	if _, ok, _ := store.Get([]byte("x")); !ok {
+		t.Error("entry written after compaction was lost")
+	}
+}
+
+func TestLogStoreCompactWhileWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	store, err := emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := make([]byte, 1000)
+	for i := range 1000 {
+		if err := store.Put([]byte{byte(i % 100)}, emys.Entry{EncryptedIndex: index, Tag: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entries written and read during compactions end up in the compacted
+	// log.
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for range 5 {
+			if err := store.Compact(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	for i := range 200 {
+		key := []byte(fmt.Sprintf("key %d", i))
+		if err := store.Put(key, emys.Entry{Tag: key}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := store.Get([]byte{byte(i % 100)}); err != nil || !ok {
+			t.Fatalf("Get(%d) = %v, %v", i%100, ok, err)
+		}
+	}
+	wg.Wait()
+	store.Close()
+
+	store, err = emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := range 200 {
+		key := []byte(fmt.Sprintf("key %d", i))
+		if entry, ok, err := store.Get(key); err != nil || !ok || string(entry.Tag) != string(key) {
+			t.Errorf("Get(%q) = %v, %v, %v", key, entry, ok, err)
+		}
+	}
+}
+
+func TestLogStoreCompactionBackoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	store, err := emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	// A directory in the way of the compacted log makes compaction fail.
+	if err := os.Mkdir(path+".compact", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	index := make([]byte, 1<<20)
+	put := func() {
+		if err := store.Put([]byte("a"), emys.Entry{EncryptedIndex: index}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 17 {
+		put()
+	}
+	if store.CompactionErr() == nil {
+		t.Fatal("compaction did not fail")
+	}
+	if err := os.Remove(path + ".compact"); err != nil {
+		t.Fatal(err)
+	}
+	put()
+	if store.CompactionErr() == nil {
+		t.Error("compaction was retried right after a failure")
+	}
+	for range 17 {
+		put()
+	}
+	if err := store.CompactionErr(); err != nil {
+		t.Errorf("compaction failed once the log doubled: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 16<<20 {
+		t.Errorf("log not compacted: %d bytes", info.Size())
+	}
+}
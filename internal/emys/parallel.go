@@ -0,0 +1,50 @@
+package emys
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// parallel calls f for every i in [0, n) on up to workers goroutines. It
+// returns the error of the lowest failing i, so that the outcome does not
+// depend on scheduling, and f must only write to per-i locations. Once ctx is
+// done, the remaining calls are skipped and fail with its error.
+func parallel(ctx context.Context, workers, n int, f func(i int) error) error {
+	call := f
+	f = func(i int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return call(i)
+	}
+	if workers <= 1 || n <= 1 {
+		for i := range n {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	errs := make([]error, n)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				errs[i] = f(i)
+			}
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package emys
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zeebo/blake3"
+)
+
+const deterministicRandomLabel = "deterministic randomness"
+
+// SetRandom makes the client draw the nonces of sealed states, the internal
+// search tokens of new chains and the identifiers of its updates from r,
+// instead of crypto/rand.Reader.
+func (c *Client) SetRandom(r io.Reader) {
+	c.random = r
+}
+
+// DeterministicRandom returns an endless stream of bytes expanded from seed.
+// A client set to read from it produces byte-identical update tokens for the
+// same calls, which is meant for golden tests and for checking other
+// implementations against this one, never for real indexes. Sealed states
+// still differ, since gob encodes maps in no particular order.
+func DeterministicRandom(seed []byte) io.Reader {
+	h, err := blake3.NewKeyed(deriveKey(seed, deterministicRandomLabel))
+	if err != nil {
+		panic(err)
+	}
+	return h.Digest()
+}
+
+func (c *Client) readRandom(what string, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.random, buf); err != nil {
+		return nil, fmt.Errorf("failed to generate %s: %w", what, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,110 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"testing/iotest"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestDeterministicRandom(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	changes := []sse.Change[uint64]{
+		{FileID: 0, Diff: emys.Diff(nil, []byte("hello world"))},
+		{FileID: 40, Diff: emys.Diff(nil, []byte("hello there"))},
+	}
+	run := func(seed string, workers int) []sse.UpdateToken {
+		config := &emys.Config{
+			MaxFiles:          70,
+			MaxSearchTrigrams: 10,
+			SearchThreshold:   0.75,
+			SegmentFiles:      32,
+			Workers:           workers,
+		}
+		client, err := emys.NewClient(key, nonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetRandom(emys.DeterministicRandom([]byte(seed)))
+		utoks, err := client.Update(changes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return utoks
+	}
+	equal := func(a, b []sse.UpdateToken) bool {
+		return slices.EqualFunc(a, b, func(a, b sse.UpdateToken) bool { return string(a) == string(b) })
+	}
+
+	utoks := run("seed", 1)
+	for _, workers := range []int{1, 4} {
+		if again := run("seed", workers); !equal(again, utoks) {
+			t.Errorf("workers=%d: tokens differ for the same seed", workers)
+		}
+	}
+	if other := run("other seed", 1); equal(other, utoks) {
+		t.Error("tokens identical for another seed")
+	}
+}
+
+func TestRandomFailure(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(id uint64, text string) error {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			return err
+		}
+		return server.ResolveUpdates(utoks...)
+	}
+	if err := update(0, "hello world"); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := errors.New("entropy source unavailable")
+	client.SetRandom(iotest.ErrReader(broken))
+	if err := update(1, "hello there"); !errors.Is(err, broken) {
+		t.Errorf("update: got %v, want %v", err, broken)
+	}
+	if _, err := client.State(); !errors.Is(err, broken) {
+		t.Errorf("state: got %v, want %v", err, broken)
+	}
+
+	// The failed update must not have advanced any chain.
+	client.SetRandom(emys.DeterministicRandom([]byte("seed")))
+	if err := update(1, "hello there"); err != nil {
+		t.Fatal(err)
+	}
+	stok, err := client.Search("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := client.OpenResult("hello", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1}; !slices.Equal(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
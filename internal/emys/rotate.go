@@ -0,0 +1,175 @@
+package emys
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"maps"
+	"slices"
+
+	"interrato.dev/emys/internal/sse"
+)
+
+// epochKey is where the server keeps the current key epoch in its store.
+var epochKey = []byte("key epoch")
+
+type cutOverToken struct {
+	Epoch  uint64
+	Chains []searchToken
+}
+
+func (c *Client) Epoch() uint64 {
+	return c.epoch
+}
+
+// Rotate starts re-keying the index under a new master key. It returns a
+// client for the next key epoch, which indexes again every file in the file
+// cache, and the update tokens that build its chains on the server. Until the
+// cut-over, the server keeps resolving the searches of c, whose updates are
+// refused from now on, as they would be lost.
+//
+// Once the tokens are resolved, the chains of c are deleted and the server is
+// moved to the new epoch by resolving the token of c.CutOver. Only the
+// client returned by Rotate is usable afterwards, and its state must be saved
+// before cutting over. Search capabilities delegated by c are revoked then.
+func (c *Client) Rotate(key []byte) (*Client, []sse.UpdateToken, error) {
+	return c.RotateContext(context.Background(), key)
+}
+
+func (c *Client) RotateContext(ctx context.Context, key []byte) (*Client, []sse.UpdateToken, error) {
+	if c.files == nil {
+		return nil, nil, fmt.Errorf("%w: required for key rotation", ErrFileCacheDisabled)
+	}
+	if len(c.peers) != 0 {
+		return nil, nil, ErrRotationWithDevices
+	}
+	next, err := NewClient(key, c.userNonce, c.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	next.device = c.device
+	next.epoch = c.epoch + 1
+	next.backupVersion = c.backupVersion
+	next.random = c.random
+	next.EnableFileCache()
+	var changes []sse.Change[uint64]
+	for _, fileID := range slices.Sorted(maps.Keys(c.files)) {
+		changes = append(changes, sse.Change[uint64]{
+			FileID: fileID,
+			Diff:   diffTrigrams(nil, c.files[fileID]),
+		})
+	}
+	utoks, err := next.UpdateContext(ctx, changes...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to re-index files: %w", err)
+	}
+	c.rotated = true
+	return next, utoks, nil
+}
+
+// CutOver returns a token asking the server to delete every chain of a client
+// replaced by Rotate and to move on to the next key epoch, atomically.
+func (c *Client) CutOver() (sse.SearchToken, error) {
+	if !c.rotated {
+		return nil, ErrNotRotated
+	}
+	tok := cutOverToken{
+		Epoch:  c.epoch + 1,
+		Chains: c.searchTokens(c.trigrams(), c.config.segments()),
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(tok); err != nil {
+		return nil, fmt.Errorf("failed to encode cut-over token: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Epoch returns the current key epoch of the index.
+func (s *Server) Epoch() (uint64, error) {
+	entry, ok, err := s.store.Get(epochKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read key epoch: %w", err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	var epoch uint64
+	dec := gob.NewDecoder(bytes.NewBuffer(entry.EncryptedIndex))
+	if err := dec.Decode(&epoch); err != nil {
+		return 0, fmt.Errorf("failed to decode key epoch: %w", err)
+	}
+	return epoch, nil
+}
+
+func (s *Server) checkEpoch(stok []searchToken) error {
+	epoch, err := s.Epoch()
+	if err != nil {
+		return err
+	}
+	for _, tok := range stok {
+		if tok.Epoch != epoch {
+			return fmt.Errorf("%w: search token of epoch %d, server at epoch %d", ErrEpochMismatch, tok.Epoch, epoch)
+		}
+	}
+	return nil
+}
+
+// ResolveCutOver deletes the chains of the retiring epoch and records the new
+// one in a single batch, so that searches switch from the old index to the
+// new one at once.
+func (s *Server) ResolveCutOver(token sse.SearchToken) error {
+	return s.ResolveCutOverContext(context.Background(), token)
+}
+
+func (s *Server) ResolveCutOverContext(ctx context.Context, token sse.SearchToken) error {
+	s.epochMu.Lock()
+	defer s.epochMu.Unlock()
+	var tok cutOverToken
+	if err := decodeToken(token, maxCheckTokenSize, "cut-over token", &tok); err != nil {
+		return err
+	}
+	if len(tok.Chains) > maxCheckChains {
+		return fmt.Errorf("%w: too many chains in cut-over token: %d", ErrMalformedToken, len(tok.Chains))
+	}
+	epoch, err := s.Epoch()
+	if err != nil {
+		return err
+	}
+	if tok.Epoch != epoch+1 {
+		return fmt.Errorf("%w: cut-over to epoch %d, server at epoch %d", ErrEpochMismatch, tok.Epoch, epoch)
+	}
+	if err := s.checkSearchTokens(tok.Chains); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(tok.Epoch); err != nil {
+		return fmt.Errorf("failed to encode key epoch: %w", err)
+	}
+	return s.transact(ctx, "cut-over", func(get GetFunc) (*Batch, error) {
+		entries := make([][][]byte, len(tok.Chains))
+		err := parallel(ctx, s.config.Workers, len(tok.Chains), func(i int) error {
+			err := s.walkChain(ctx, get, tok.Chains[i], func(iutok []byte, _ Entry) error {
+				entries[i] = append(entries[i], slices.Clone(iutok))
+				return nil
+			})
+			if err != nil {
+				return &ChainError{Chain: i, Segment: tok.Chains[i].Segment, Err: err}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		b := new(Batch)
+		for _, chain := range entries {
+			for _, iutok := range chain {
+				b.Delete(iutok)
+			}
+		}
+		b.Put(epochKey, Entry{EncryptedIndex: buf.Bytes()})
+		return b, nil
+	})
+}
@@ -0,0 +1,131 @@
+package emys_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestRotate(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	newKey := []byte("PURPLE SUBMARINE, WHITE WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          70,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableFileCache()
+	server, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setContent := func(client *emys.Client, id uint64, text string) {
+		utoks, err := client.SetContent(id, []byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(searcher sse.Searcher[uint64], text string) ([]uint64, error) {
+		stok, err := searcher.Search(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := server.ResolveSearch(stok)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := searcher.OpenResult(text, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, nil
+	}
+
+	setContent(client, 0, "hello world")
+	setContent(client, 1, "hello there")
+	setContent(client, 1, "goodbye there")
+	setContent(client, 2, "say hello")
+	capability, err := client.DelegateSearch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := emys.NewDelegatedSearcher(capability)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, utoks, err := client.Rotate(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Epoch() != 1 {
+		t.Errorf("Epoch() = %d, want 1", next.Epoch())
+	}
+	if err := server.ResolveUpdates(utoks...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SetContent(3, []byte("hello late")); err == nil {
+		t.Error("update accepted after rotation")
+	}
+	// The old index keeps serving searches until the cut-over.
+	if got, err := search(client, "hello"); err != nil || !slices.Equal(got, []uint64{0, 2}) {
+		t.Errorf("search before cut-over = %v, %v, want [0 2]", got, err)
+	}
+	if _, err := search(next, "hello"); !errors.Is(err, emys.ErrEpochMismatch) {
+		t.Errorf("search of next epoch before cut-over error = %v, want ErrEpochMismatch", err)
+	}
+
+	ctok, err := client.CutOver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveCutOver(ctok); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ResolveCutOver(ctok); !errors.Is(err, emys.ErrEpochMismatch) {
+		t.Errorf("repeated cut-over error = %v, want ErrEpochMismatch", err)
+	}
+	if epoch, err := server.Epoch(); err != nil || epoch != 1 {
+		t.Errorf("server Epoch() = %d, %v, want 1", epoch, err)
+	}
+	for name, searcher := range map[string]sse.Searcher[uint64]{"old client": client, "delegate": auditor} {
+		if _, err := search(searcher, "hello"); !errors.Is(err, emys.ErrEpochMismatch) {
+			t.Errorf("%s search after cut-over error = %v, want ErrEpochMismatch", name, err)
+		}
+	}
+	if got, err := search(next, "hello"); err != nil || !slices.Equal(got, []uint64{0, 2}) {
+		t.Errorf("search after cut-over = %v, %v, want [0 2]", got, err)
+	}
+	setContent(next, 3, "hello again")
+	if got, err := search(next, "hello"); err != nil || !slices.Equal(got, []uint64{0, 2, 3}) {
+		t.Errorf("search after update = %v, %v, want [0 2 3]", got, err)
+	}
+
+	// No entry of the old epoch is left behind.
+	ctok, err = next.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := server.ResolveCheck(ctok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := next.OpenCheck(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("check after rotation: %+v", report)
+	}
+}
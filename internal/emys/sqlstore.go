@@ -0,0 +1,231 @@
+package emys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// SQLDialect adapts SQLStore to the flavor of SQL spoken by a database.
+type SQLDialect struct {
+	// Placeholder returns the marker of the n-th query argument, from 1.
+	Placeholder func(n int) string
+	// KeyType and ValueType are the column types of the internal update
+	// token and of the other fields.
+	KeyType, ValueType string
+}
+
+var (
+	SQLiteDialect = SQLDialect{
+		Placeholder: func(int) string { return "?" },
+		KeyType:     "BLOB",
+		ValueType:   "BLOB",
+	}
+	PostgreSQLDialect = SQLDialect{
+		Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		KeyType:     "BYTEA",
+		ValueType:   "BYTEA",
+	}
+	MySQLDialect = SQLDialect{
+		Placeholder: func(int) string { return "?" },
+		KeyType:     "VARBINARY(64)",
+		ValueType:   "LONGBLOB",
+	}
+)
+
+// SQLStore keeps chain entries in a table of a database/sql database, one row
+// per entry keyed by internal update token. Every batch runs in a single
+// transaction, and so does the compaction of a search together with the walk
+// of its chains.
+//
+// Writing transactions first update the only row of a companion table, named
+// after the table with a _lock suffix, which makes them wait for each other
+// on every database. SQLite reports a busy database instead of waiting unless
+// it is opened with a busy timeout, or with a single connection.
+type SQLStore struct {
+	db     *sql.DB
+	get    string
+	del    string
+	insert string
+	keys   string
+	lock   string
+}
+
+var _ Store = &SQLStore{}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NewSQLStore returns a store backed by the given table, which is created if
+// it does not exist yet.
+func NewSQLStore(db *sql.DB, table string, dialect SQLDialect) (*SQLStore, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %q", table)
+	}
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		iutok %s PRIMARY KEY,
+		masked_istok %s,
+		encrypted_index %s NOT NULL,
+		tag %s NOT NULL
+	)`, table, dialect.KeyType, dialect.ValueType, dialect.ValueType, dialect.ValueType)
+	if _, err := db.Exec(create); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	// Two stores racing to create the lock row may insert it twice, which
+	// is harmless, since writers update every row.
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_lock (version BIGINT NOT NULL)", table)); err != nil {
+		return nil, fmt.Errorf("failed to create lock table: %w", err)
+	}
+	var rows int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s_lock", table)).Scan(&rows); err != nil {
+		return nil, fmt.Errorf("failed to query lock table: %w", err)
+	}
+	if rows == 0 {
+		if _, err := db.Exec(fmt.Sprintf("INSERT INTO %s_lock (version) VALUES (0)", table)); err != nil {
+			return nil, fmt.Errorf("failed to create lock row: %w", err)
+		}
+	}
+	p := dialect.Placeholder
+	return &SQLStore{
+		db: db,
+		get: fmt.Sprintf("SELECT masked_istok, encrypted_index, tag FROM %s WHERE iutok = %s",
+			table, p(1)),
+		del: fmt.Sprintf("DELETE FROM %s WHERE iutok = %s", table, p(1)),
+		insert: fmt.Sprintf("INSERT INTO %s (iutok, masked_istok, encrypted_index, tag) VALUES (%s, %s, %s, %s)",
+			table, p(1), p(2), p(3), p(4)),
+		keys: fmt.Sprintf("SELECT iutok FROM %s", table),
+		lock: fmt.Sprintf("UPDATE %s_lock SET version = version + 1", table),
+	}, nil
+}
+
+func (s *SQLStore) Get(key []byte) (Entry, bool, error) {
+	return scanEntry(s.db.QueryRow(s.get, key))
+}
+
+func scanEntry(row *sql.Row) (Entry, bool, error) {
+	var entry Entry
+	err := row.Scan(&entry.MaskedInternalSearchToken, &entry.EncryptedIndex, &entry.Tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to query entry: %w", err)
+	}
+	return entry, true, nil
+}
+
+func (s *SQLStore) Put(key []byte, entry Entry) error {
+	var b Batch
+	b.Put(key, entry)
+	return s.Apply(&b)
+}
+
+func (s *SQLStore) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return s.Apply(&b)
+}
+
+func (s *SQLStore) Apply(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return s.Transact(func(GetFunc) (*Batch, error) {
+		return b, nil
+	})
+}
+
+// Transact serializes the reads of fn, since a transaction holds a single
+// connection, which some drivers cannot share between queries in flight.
+//
+// Entries are replaced by deleting and inserting rows, which unlike upserts
+// works the same in every dialect.
+func (s *SQLStore) Transact(fn func(get GetFunc) (*Batch, error)) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.lock); err != nil {
+		return fmt.Errorf("failed to lock table: %w", err)
+	}
+	var mu sync.Mutex
+	b, err := fn(func(key []byte) (Entry, bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return scanEntry(tx.QueryRowContext(ctx, s.get, key))
+	})
+	if err != nil {
+		return err
+	}
+	if b == nil || b.Len() == 0 {
+		return nil
+	}
+	del, err := tx.PrepareContext(ctx, s.del)
+	if err != nil {
+		return fmt.Errorf("failed to prepare delete: %w", err)
+	}
+	defer del.Close()
+	insert, err := tx.PrepareContext(ctx, s.insert)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer insert.Close()
+	for _, op := range b.ops {
+		if _, err := del.ExecContext(ctx, op.key); err != nil {
+			return fmt.Errorf("failed to delete entry: %w", err)
+		}
+		if op.delete {
+			continue
+		}
+		e := op.entry
+		if _, err := insert.ExecContext(ctx, op.key, e.MaskedInternalSearchToken, nonNil(e.EncryptedIndex), nonNil(e.Tag)); err != nil {
+			return fmt.Errorf("failed to insert entry: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// nonNil keeps empty fields apart from NULL, which only a missing masked
+// search token is stored as.
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// Keys reads all keys before calling fn, so that fn can query the store even
+// on a database with a single connection.
+func (s *SQLStore) Keys(fn func(key []byte) error) error {
+	rows, err := s.db.Query(s.keys)
+	if err != nil {
+		return fmt.Errorf("failed to query keys: %w", err)
+	}
+	var keys [][]byte
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("failed to read keys: %w", err)
+	}
+	rows.Close()
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package emys_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	_ "modernc.org/sqlite"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func openSQLite(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// SQLite accepts the placeholders and column types of the other dialects,
+// so their statements are run against it too.
+var sqlDialects = map[string]emys.SQLDialect{
+	"SQLite":     emys.SQLiteDialect,
+	"PostgreSQL": emys.PostgreSQLDialect,
+	"MySQL":      emys.MySQLDialect,
+}
+
+func TestSQLStore(t *testing.T) {
+	for name, dialect := range sqlDialects {
+		t.Run(name, func(t *testing.T) {
+			db := openSQLite(t, ":memory:")
+			store, err := emys.NewSQLStore(db, "entries", dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testStore(t, store)
+
+			if _, err := emys.NewSQLStore(db, "entries; DROP TABLE entries", dialect); err == nil {
+				t.Error("invalid table name was accepted")
+			}
+		})
+	}
+}
+
+func TestConcurrentSearchesWithSQLStore(t *testing.T) {
+	for name, dialect := range sqlDialects {
+		t.Run(name, func(t *testing.T) {
+			// Several connections let transactions overlap, and the busy
+			// timeout makes them wait for the lock instead of failing.
+			db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "emys.db")+"?_pragma=busy_timeout(10000)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.SetMaxOpenConns(8)
+			t.Cleanup(func() { db.Close() })
+			store, err := emys.NewSQLStore(db, "entries", dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testConcurrentSearches(t, store)
+		})
+	}
+}
+
+func TestServerWithSQLStore(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	path := filepath.Join(t.TempDir(), "emys.db")
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := emys.NewSQLStore(openSQLite(t, path), "entries", emys.SQLiteDialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"Hello, Gopher!", "Hello, 世界", "Gophers everywhere"} {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: uint64(i), Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func() int {
+		n := 0
+		if err := store.Keys(func([]byte) error { n++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := count()
+	for range 2 {
+		// A fresh connection sees what the previous one committed.
+		store, err := emys.NewSQLStore(openSQLite(t, path), "entries", emys.SQLiteDialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServerWithStore(config, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stok, err := client.Search("Gopher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult("Gopher", result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, []uint64{0, 2}) {
+			t.Errorf("got %v, want [0 2]", ids)
+		}
+	}
+	if after := count(); after >= before {
+		t.Errorf("search did not compact chains: %d entries, %d before", after, before)
+	}
+}
@@ -0,0 +1,138 @@
+package emys
+
+import "sync"
+
+// Entry is a chain entry as kept by the server, keyed by its internal update
+// token.
+type Entry struct {
+	MaskedInternalSearchToken []byte
+	EncryptedIndex            []byte
+	Tag                       []byte
+}
+
+// Store holds the chain entries of a Server. Get may be called concurrently,
+// and stored entries must not be modified by either side.
+type Store interface {
+	Get(key []byte) (Entry, bool, error)
+	Put(key []byte, entry Entry) error
+	Delete(key []byte) error
+	// Apply performs all the operations of a batch, or none of them.
+	Apply(b *Batch) error
+	// Transact calls fn, which reads the store through get, possibly
+	// concurrently, and applies the batch fn returns, if any, in the same
+	// transaction: no other batch lands between those reads and the batch.
+	// An error from fn is returned as is.
+	Transact(fn func(get GetFunc) (*Batch, error)) error
+	// Keys calls fn with every key in the store, in no particular order,
+	// stopping at the first error.
+	Keys(fn func(key []byte) error) error
+}
+
+// GetFunc reads an entry within a transaction, like Store.Get.
+type GetFunc func(key []byte) (Entry, bool, error)
+
+// Batch is a sequence of operations applied atomically by Store.Apply.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	entry  Entry
+	delete bool
+}
+
+func (b *Batch) Put(key []byte, entry Entry) {
+	b.ops = append(b.ops, batchOp{key: key, entry: entry})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// MemoryStore keeps every entry in a map.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]Entry)}
+}
+
+var _ Store = &MemoryStore{}
+
+func (m *MemoryStore) Get(key []byte) (Entry, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entry, ok := m.entries[string(key)]
+	return entry, ok, nil
+}
+
+func (m *MemoryStore) Put(key []byte, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[string(key)] = entry
+	return nil
+}
+
+func (m *MemoryStore) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, string(key))
+	return nil
+}
+
+func (m *MemoryStore) Apply(b *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply(b)
+	return nil
+}
+
+// Transact holds the store for writing while fn runs, so that reads and
+// batches of other goroutines wait for it.
+func (m *MemoryStore) Transact(fn func(get GetFunc) (*Batch, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := fn(func(key []byte) (Entry, bool, error) {
+		entry, ok := m.entries[string(key)]
+		return entry, ok, nil
+	})
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		m.apply(b)
+	}
+	return nil
+}
+
+func (m *MemoryStore) apply(b *Batch) {
+	for _, op := range b.ops {
+		if op.delete {
+			delete(m.entries, string(op.key))
+		} else {
+			m.entries[string(op.key)] = op.entry
+		}
+	}
+}
+
+func (m *MemoryStore) Keys(fn func(key []byte) error) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	for _, key := range keys {
+		if err := fn([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package emys_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func testStore(t *testing.T, store emys.Store) {
+	entry := func(i byte) emys.Entry {
+		return emys.Entry{
+			MaskedInternalSearchToken: []byte{i, 1},
+			EncryptedIndex:            []byte{i, 2, 2},
+			Tag:                       []byte{i, 3, 3, 3},
+		}
+	}
+	if err := store.Put([]byte("a"), entry(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put([]byte("b"), entry(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put([]byte("a"), entry(3)); err != nil {
+		t.Fatal(err)
+	}
+	var b emys.Batch
+	b.Delete([]byte("b"))
+	b.Put([]byte("c"), emys.Entry{EncryptedIndex: []byte{4}})
+	b.Put([]byte("d"), entry(5))
+	b.Delete([]byte("d"))
+	if err := store.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete([]byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := store.Get([]byte("a"))
+	if err != nil || !ok {
+		t.Fatalf("Get(a) = %v, %v", ok, err)
+	}
+	if want := entry(3); !bytes.Equal(got.Tag, want.Tag) || !bytes.Equal(got.EncryptedIndex, want.EncryptedIndex) ||
+		!bytes.Equal(got.MaskedInternalSearchToken, want.MaskedInternalSearchToken) {
+		t.Errorf("Get(a) = %v, want %v", got, want)
+	}
+	got, ok, err = store.Get([]byte("c"))
+	if err != nil || !ok {
+		t.Fatalf("Get(c) = %v, %v", ok, err)
+	}
+	if got.MaskedInternalSearchToken != nil || got.Tag != nil || !bytes.Equal(got.EncryptedIndex, []byte{4}) {
+		t.Errorf("Get(c) = %v", got)
+	}
+	for _, key := range []string{"b", "d", "missing"} {
+		if _, ok, err := store.Get([]byte(key)); err != nil || ok {
+			t.Errorf("Get(%s) = %v, %v", key, ok, err)
+		}
+	}
+	err = store.Transact(func(get emys.GetFunc) (*emys.Batch, error) {
+		entry, ok, err := get([]byte("a"))
+		if err != nil || !ok {
+			t.Fatalf("get(a) = %v, %v", ok, err)
+		}
+		var b emys.Batch
+		b.Put([]byte("e"), entry)
+		b.Delete([]byte("e"))
+		return &b, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("failed")
+	err = store.Transact(func(emys.GetFunc) (*emys.Batch, error) {
+		var b emys.Batch
+		b.Delete([]byte("a"))
+		return &b, failed
+	})
+	if err != failed {
+		t.Errorf("Transact returned %v, want %v", err, failed)
+	}
+	if _, ok, err := store.Get([]byte("a")); err != nil || !ok {
+		t.Errorf("batch of a failed transaction was applied: Get(a) = %v, %v", ok, err)
+	}
+
+	var keys []string
+	err = store.Keys(func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Sort(keys); !slices.Equal(keys, []string{"a", "c"}) {
+		t.Errorf("Keys() = %v, want [a c]", keys)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, emys.NewMemoryStore())
+}
+
+// slowStore delays reads like a store over a network would, which widens
+// the window for concurrent searches to interleave.
+type slowStore struct {
+	*emys.MemoryStore
+}
+
+func (s slowStore) Get(key []byte) (emys.Entry, bool, error) {
+	time.Sleep(200 * time.Microsecond)
+	return s.MemoryStore.Get(key)
+}
+
+func (s slowStore) Transact(fn func(get emys.GetFunc) (*emys.Batch, error)) error {
+	return s.MemoryStore.Transact(func(get emys.GetFunc) (*emys.Batch, error) {
+		return fn(func(key []byte) (emys.Entry, bool, error) {
+			time.Sleep(200 * time.Microsecond)
+			return get(key)
+		})
+	})
+}
+
+func TestConcurrentSearches(t *testing.T) {
+	testConcurrentSearches(t, slowStore{emys.NewMemoryStore()})
+}
+
+// testConcurrentSearches resolves the same search token many times at once,
+// so that every chain is compacted concurrently with its own compaction.
+func testConcurrentSearches(t *testing.T, store emys.Store) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"Hello, Gopher!", "Hello, 世界", "Gophers everywhere"} {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: uint64(i), Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stok, err := client.Search("Gopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]sse.SearchResult, 20)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Go(func() {
+			result, err := server.ResolveSearch(stok)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = result
+		})
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	for _, result := range results {
+		ids, err := client.OpenResult("Gopher", result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, []uint64{0, 2}) {
+			t.Errorf("got %v, want [0 2]", ids)
+		}
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	store, err := emys.OpenLogStore(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestServerWithStore(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	path := filepath.Join(t.TempDir(), "log")
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"Hello, Gopher!", "Hello, 世界", "Gophers everywhere"} {
+		store, err := emys.OpenLogStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServerWithStore(config, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utoks, err := client.Update(sse.Change[uint64]{FileID: uint64(i), Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := emys.OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server, err := emys.NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		stok, err := client.Search("Gopher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult("Gopher", result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, []uint64{0, 2}) {
+			t.Errorf("got %v, want [0 2]", ids)
+		}
+	}
+
+	state, err := server.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory, err := emys.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	stok, err := client.Search("Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := memory.ResolveSearch(stok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := client.OpenResult("Hello", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []uint64{0, 1}) {
+		t.Errorf("got %v from snapshot, want [0 1]", ids)
+	}
+}
@@ -0,0 +1,311 @@
+package emys
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"interrato.dev/emys/internal/ahe"
+	"interrato.dev/emys/internal/ahmac"
+	"interrato.dev/emys/internal/bitset"
+	"interrato.dev/emys/internal/sse"
+)
+
+// hexBytes is a byte string encoded as lowercase hex in vectors.
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+// vectors are known answers for every building block of the scheme and for
+// whole update and search flows, meant to check other implementations
+// against this one.
+type vectors struct {
+	Label       string              `json:"label"`
+	DeriveKey   []deriveKeyVector   `json:"derive_key"`
+	KeyFromSeed []keyFromSeedVector `json:"ahe_key_from_seed"`
+	MAC         []macVector         `json:"ahmac_mac"`
+	Layout      []layoutVector      `json:"bitset_layout"`
+	Diff        []diffVector        `json:"diff"`
+	Flows       []flowVector        `json:"flows"`
+}
+
+type deriveKeyVector struct {
+	MasterKey hexBytes `json:"master_key"`
+	Contexts  []string `json:"contexts"`
+	// Canonical is the context string actually passed to BLAKE3, which
+	// starts with the label.
+	Canonical hexBytes `json:"canonical"`
+	Key       hexBytes `json:"key"`
+}
+
+type keyFromSeedVector struct {
+	Seed   hexBytes `json:"seed"`
+	Blocks uint64   `json:"blocks"`
+	Key    hexBytes `json:"key"`
+}
+
+type macVector struct {
+	IntegrityKeySeed      hexBytes `json:"integrity_key_seed"`
+	IntegrityKey          hexBytes `json:"integrity_key"`
+	AuthenticationKeySeed hexBytes `json:"authentication_key_seed"`
+	AuthenticationKey     hexBytes `json:"authentication_key"`
+	Message               hexBytes `json:"message"`
+	Tag                   hexBytes `json:"tag"`
+}
+
+type layoutVector struct {
+	Counters uint64          `json:"counters"`
+	Width    uint64          `json:"width"`
+	Values   []counterVector `json:"values"`
+	Negated  bool            `json:"negated"`
+	Bytes    hexBytes        `json:"bytes"`
+}
+
+type counterVector struct {
+	Counter uint64 `json:"counter"`
+	Value   uint64 `json:"value"`
+}
+
+type diffVector struct {
+	Old      string   `json:"old"`
+	New      string   `json:"new"`
+	Diff     string   `json:"diff"`
+	Removed  []string `json:"removed"`
+	Inserted []string `json:"inserted"`
+}
+
+type flowVector struct {
+	Key        hexBytes   `json:"key"`
+	UserNonce  hexBytes   `json:"user_nonce"`
+	RandomSeed hexBytes   `json:"random_seed"`
+	Config     flowConfig `json:"config"`
+	Steps      []flowStep `json:"steps"`
+}
+
+type flowConfig struct {
+	MaxFiles            uint64   `json:"max_files"`
+	MaxSearchTrigrams   uint16   `json:"max_search_trigrams"`
+	SearchThreshold     float64  `json:"search_threshold"`
+	SegmentFiles        uint64   `json:"segment_files"`
+	CounterBits         uint8    `json:"counter_bits"`
+	DerivedSearchTokens bool     `json:"derived_search_tokens"`
+	Fingerprint         hexBytes `json:"fingerprint"`
+}
+
+// flowStep is either an update, with changes and the tokens they yield, or a
+// search, with the token, the result of the server and the matching files.
+type flowStep struct {
+	Changes      []flowChange `json:"changes,omitempty"`
+	UpdateTokens []hexBytes   `json:"update_tokens,omitempty"`
+	Query        string       `json:"query,omitempty"`
+	SearchToken  hexBytes     `json:"search_token,omitempty"`
+	SearchResult hexBytes     `json:"search_result,omitempty"`
+	FileIDs      []uint64     `json:"file_ids,omitempty"`
+}
+
+type flowChange struct {
+	FileID uint64 `json:"file_id"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	Diff   string `json:"diff"`
+}
+
+// GenerateVectors returns the known-answer vectors as indented JSON. They
+// depend on nothing but the implementation, so generating them twice yields
+// the same bytes.
+func GenerateVectors() ([]byte, error) {
+	v := vectors{Label: emysLabel}
+	masterKey := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	for _, contexts := range [][]string{
+		{"THIS USER IS FOR TESTING", integrityKeyLabel},
+		{"THIS USER IS FOR TESTING", encryptionKeyLabel, "hel"},
+		{"THIS USER IS FOR TESTING", authenticationKeyLabel, "hel", "segment 256", "device laptop", "epoch 1", "3"},
+		{"", "é"},
+	} {
+		v.DeriveKey = append(v.DeriveKey, deriveKeyVector{
+			MasterKey: masterKey,
+			Contexts:  contexts,
+			Canonical: canonicalize(append([]string{emysLabel}, contexts...)...),
+			Key:       deriveKey(masterKey, contexts...),
+		})
+	}
+
+	for _, blocks := range []uint64{1, 4} {
+		seed := deriveKey(masterKey, fmt.Sprintf("key from seed %d", blocks))
+		key, err := ahe.KeyFromSeed(seed, blocks)
+		if err != nil {
+			return nil, err
+		}
+		v.KeyFromSeed = append(v.KeyFromSeed, keyFromSeedVector{Seed: seed, Blocks: blocks, Key: key})
+	}
+
+	layouts := []layoutVector{
+		{Counters: 10, Width: 1, Values: []counterVector{{0, 1}, {3, 1}, {9, 1}}},
+		{Counters: 300, Width: 1, Values: []counterVector{{0, 1}, {255, 1}, {256, 1}, {299, 1}}},
+		{Counters: 70, Width: 5, Values: []counterVector{{0, 1}, {50, 17}, {51, 31}, {69, 2}}},
+		{Counters: 10, Width: 1, Values: []counterVector{{2, 1}}, Negated: true},
+	}
+	for _, l := range layouts {
+		layout := bitset.Layout{Counters: l.Counters, Width: l.Width}
+		bs := bitset.New(layout.Len())
+		for _, c := range l.Values {
+			for bit := range l.Width {
+				if c.Value>>bit&1 == 1 {
+					if err := bs.Set(layout.Offset(c.Counter) + bit); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		if l.Negated {
+			if err := bs.Neg(); err != nil {
+				return nil, err
+			}
+		}
+		l.Bytes = bs.Bytes()
+		v.Layout = append(v.Layout, l)
+	}
+
+	for i, l := range v.Layout[:2] {
+		ikeySeed := []byte(fmt.Sprintf("integrity key %d", i))
+		akeySeed := []byte(fmt.Sprintf("authentication key %d", i))
+		ikey, akey := ahmac.UniformKey(ikeySeed), ahmac.UniformKey(akeySeed)
+		tag, err := ahmac.MAC(ikey, akey, l.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		v.MAC = append(v.MAC, macVector{
+			IntegrityKeySeed:      ikeySeed,
+			IntegrityKey:          ikey,
+			AuthenticationKeySeed: akeySeed,
+			AuthenticationKey:     akey,
+			Message:               l.Bytes,
+			Tag:                   tag,
+		})
+	}
+
+	for _, d := range [][2]string{
+		{"", "hello"},
+		{"hello world", "hello there"},
+		{"ünïcödé", "ab"},
+	} {
+		diff := Diff([]byte(d[0]), []byte(d[1]))
+		removed, inserted, err := ParseDiff(diff)
+		if err != nil {
+			return nil, err
+		}
+		v.Diff = append(v.Diff, diffVector{
+			Old:      d[0],
+			New:      d[1],
+			Diff:     string(diff),
+			Removed:  append([]string{}, removed...),
+			Inserted: append([]string{}, inserted...),
+		})
+	}
+
+	flows := []struct {
+		config *Config
+		steps  []flowStep
+	}{
+		{
+			config: &Config{MaxFiles: 10, MaxSearchTrigrams: 10, SearchThreshold: 0.75},
+			steps: []flowStep{
+				{Changes: []flowChange{{FileID: 0, New: "hello world"}, {FileID: 1, New: "hello there"}}},
+				{Query: "hello"},
+				{Changes: []flowChange{{FileID: 1, Old: "hello there", New: "goodbye there"}}},
+				{Query: "hello"},
+				{Query: "there"},
+			},
+		},
+		{
+			config: &Config{
+				MaxFiles: 600, MaxSearchTrigrams: 10, SearchThreshold: 0.75,
+				SegmentFiles: 256, CounterBits: 4, DerivedSearchTokens: true,
+			},
+			steps: []flowStep{
+				{Changes: []flowChange{{FileID: 0, New: "hello world"}, {FileID: 300, New: "say hello"}}},
+				{Changes: []flowChange{{FileID: 599, New: "hello again"}}},
+				{Query: "hello"},
+				{Changes: []flowChange{{FileID: 300, Old: "say hello", New: ""}}},
+				{Query: "hello"},
+			},
+		},
+	}
+	for i, f := range flows {
+		flow, err := generateFlow(fmt.Sprintf("flow %d", i), f.config, f.steps)
+		if err != nil {
+			return nil, fmt.Errorf("flow %d: %w", i, err)
+		}
+		v.Flows = append(v.Flows, flow)
+	}
+
+	out, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vectors: %w", err)
+	}
+	return append(out, '\n'), nil
+}
+
+func generateFlow(name string, config *Config, steps []flowStep) (flowVector, error) {
+	flow := flowVector{
+		Key:        deriveKey([]byte(name), "key"),
+		UserNonce:  deriveKey([]byte(name), "user nonce")[:24],
+		RandomSeed: []byte(name),
+		Config: flowConfig{
+			MaxFiles:            config.MaxFiles,
+			MaxSearchTrigrams:   config.MaxSearchTrigrams,
+			SearchThreshold:     config.SearchThreshold,
+			SegmentFiles:        config.SegmentFiles,
+			CounterBits:         config.CounterBits,
+			DerivedSearchTokens: config.DerivedSearchTokens,
+			Fingerprint:         config.Fingerprint(),
+		},
+	}
+	client, err := NewClient(flow.Key, flow.UserNonce, config)
+	if err != nil {
+		return flowVector{}, err
+	}
+	client.SetRandom(DeterministicRandom(flow.RandomSeed))
+	server, err := NewServer(config)
+	if err != nil {
+		return flowVector{}, err
+	}
+	for _, step := range steps {
+		if step.Changes != nil {
+			var changes []sse.Change[uint64]
+			for i, change := range step.Changes {
+				diff := Diff([]byte(change.Old), []byte(change.New))
+				step.Changes[i].Diff = string(diff)
+				changes = append(changes, sse.Change[uint64]{FileID: change.FileID, Diff: diff})
+			}
+			utoks, err := client.Update(changes...)
+			if err != nil {
+				return flowVector{}, err
+			}
+			if err := server.ResolveUpdates(utoks...); err != nil {
+				return flowVector{}, err
+			}
+			for _, utok := range utoks {
+				step.UpdateTokens = append(step.UpdateTokens, hexBytes(utok))
+			}
+		} else {
+			stok, err := client.Search(step.Query)
+			if err != nil {
+				return flowVector{}, err
+			}
+			res, err := server.ResolveSearch(stok)
+			if err != nil {
+				return flowVector{}, err
+			}
+			ids, err := client.OpenResult(step.Query, res)
+			if err != nil {
+				return flowVector{}, err
+			}
+			step.SearchToken, step.SearchResult, step.FileIDs = hexBytes(stok), hexBytes(res), ids
+		}
+		flow.Steps = append(flow.Steps, step)
+	}
+	return flow, nil
+}
@@ -0,0 +1,249 @@
+package emys_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/ahe"
+	"interrato.dev/emys/internal/ahmac"
+	"interrato.dev/emys/internal/bitset"
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+const vectorsFile = "testdata/vectors.json"
+
+// The vectors are read back into types of their own, as another
+// implementation would, rather than into those of the generator.
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	*h = b
+	return err
+}
+
+type testVectors struct {
+	KeyFromSeed []struct {
+		Seed   hexBytes
+		Blocks uint64
+		Key    hexBytes
+	} `json:"ahe_key_from_seed"`
+	MAC []struct {
+		IntegrityKeySeed      hexBytes `json:"integrity_key_seed"`
+		IntegrityKey          hexBytes `json:"integrity_key"`
+		AuthenticationKeySeed hexBytes `json:"authentication_key_seed"`
+		AuthenticationKey     hexBytes `json:"authentication_key"`
+		Message               hexBytes
+		Tag                   hexBytes
+	} `json:"ahmac_mac"`
+	Layout []struct {
+		Counters uint64
+		Width    uint64
+		Values   []struct{ Counter, Value uint64 }
+		Negated  bool
+		Bytes    hexBytes
+	} `json:"bitset_layout"`
+	Diff []struct {
+		Old, New, Diff    string
+		Removed, Inserted []string
+	}
+	Flows []struct {
+		Key        hexBytes
+		UserNonce  hexBytes `json:"user_nonce"`
+		RandomSeed hexBytes `json:"random_seed"`
+		Config     struct {
+			MaxFiles            uint64  `json:"max_files"`
+			MaxSearchTrigrams   uint16  `json:"max_search_trigrams"`
+			SearchThreshold     float64 `json:"search_threshold"`
+			SegmentFiles        uint64  `json:"segment_files"`
+			CounterBits         uint8   `json:"counter_bits"`
+			DerivedSearchTokens bool    `json:"derived_search_tokens"`
+			Fingerprint         hexBytes
+		}
+		Steps []struct {
+			Changes []struct {
+				FileID         uint64 `json:"file_id"`
+				Old, New, Diff string
+			}
+			UpdateTokens []hexBytes `json:"update_tokens"`
+			Query        string
+			SearchToken  hexBytes `json:"search_token"`
+			SearchResult hexBytes `json:"search_result"`
+			FileIDs      []uint64 `json:"file_ids"`
+		}
+	}
+}
+
+func TestVectorsUpToDate(t *testing.T) {
+	committed, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := emys.GenerateVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, committed) {
+		t.Errorf("%s is out of date, regenerate it with: go run ./cmd/emys vectors", vectorsFile)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	data, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v testVectors
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tv := range v.KeyFromSeed {
+		key, err := ahe.KeyFromSeed(tv.Seed, tv.Blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, tv.Key) {
+			t.Errorf("ahe_key_from_seed %d: got %x, want %x", i, key, tv.Key)
+		}
+	}
+
+	for i, tv := range v.MAC {
+		ikey, akey := ahmac.UniformKey(tv.IntegrityKeySeed), ahmac.UniformKey(tv.AuthenticationKeySeed)
+		if !bytes.Equal(ikey, tv.IntegrityKey) || !bytes.Equal(akey, tv.AuthenticationKey) {
+			t.Errorf("ahmac_mac %d: uniform keys %x and %x, want %x and %x", i, ikey, akey, tv.IntegrityKey, tv.AuthenticationKey)
+		}
+		tag, err := ahmac.MAC(tv.IntegrityKey, tv.AuthenticationKey, tv.Message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tag, tv.Tag) {
+			t.Errorf("ahmac_mac %d: got %x, want %x", i, tag, tv.Tag)
+		}
+	}
+
+	for i, tv := range v.Layout {
+		layout := bitset.Layout{Counters: tv.Counters, Width: tv.Width}
+		bs := bitset.New(layout.Len())
+		for _, c := range tv.Values {
+			for bit := range tv.Width {
+				if c.Value>>bit&1 == 1 {
+					if err := bs.Set(layout.Offset(c.Counter) + bit); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		if tv.Negated {
+			if err := bs.Neg(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			got := make(map[uint64]uint64)
+			err := layout.Decode(tv.Bytes, 0, func(i, counter uint64) {
+				if counter != 0 {
+					got[i] = counter
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tv.Values {
+				if got[c.Counter] != c.Value {
+					t.Errorf("bitset_layout %d: counter %d decoded as %d, want %d", i, c.Counter, got[c.Counter], c.Value)
+				}
+			}
+		}
+		if !bytes.Equal(bs.Bytes(), tv.Bytes) {
+			t.Errorf("bitset_layout %d: got %x, want %x", i, bs.Bytes(), tv.Bytes)
+		}
+	}
+
+	for i, tv := range v.Diff {
+		if diff := emys.Diff([]byte(tv.Old), []byte(tv.New)); string(diff) != tv.Diff {
+			t.Errorf("diff %d: got %q, want %q", i, diff, tv.Diff)
+		}
+		removed, inserted, err := emys.ParseDiff([]byte(tv.Diff))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(removed, tv.Removed) || !slices.Equal(inserted, tv.Inserted) {
+			t.Errorf("diff %d: parsed as %q and %q, want %q and %q", i, removed, inserted, tv.Removed, tv.Inserted)
+		}
+	}
+
+	for i, flow := range v.Flows {
+		config := &emys.Config{
+			MaxFiles:            flow.Config.MaxFiles,
+			MaxSearchTrigrams:   flow.Config.MaxSearchTrigrams,
+			SearchThreshold:     flow.Config.SearchThreshold,
+			SegmentFiles:        flow.Config.SegmentFiles,
+			CounterBits:         flow.Config.CounterBits,
+			DerivedSearchTokens: flow.Config.DerivedSearchTokens,
+		}
+		if fp := config.Fingerprint(); !bytes.Equal(fp, flow.Config.Fingerprint) {
+			t.Errorf("flow %d: fingerprint %x, want %x", i, fp, flow.Config.Fingerprint)
+		}
+		client, err := emys.NewClient(flow.Key, flow.UserNonce, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetRandom(emys.DeterministicRandom(flow.RandomSeed))
+		server, err := emys.NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, step := range flow.Steps {
+			if step.Changes != nil {
+				var changes []sse.Change[uint64]
+				for _, change := range step.Changes {
+					if diff := emys.Diff([]byte(change.Old), []byte(change.New)); string(diff) != change.Diff {
+						t.Errorf("flow %d, step %d: diff %q, want %q", i, j, diff, change.Diff)
+					}
+					changes = append(changes, sse.Change[uint64]{FileID: change.FileID, Diff: []byte(change.Diff)})
+				}
+				utoks, err := client.Update(changes...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.EqualFunc(utoks, step.UpdateTokens, func(a sse.UpdateToken, b hexBytes) bool { return bytes.Equal(a, b) }) {
+					t.Errorf("flow %d, step %d: update tokens differ", i, j)
+				}
+				// The server is fed the committed tokens, so that its
+				// results are checked even if the client diverged.
+				for _, utok := range step.UpdateTokens {
+					if err := server.ResolveUpdates(sse.UpdateToken(utok)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				continue
+			}
+			stok, err := client.Search(step.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stok, step.SearchToken) {
+				t.Errorf("flow %d, step %d: search token differs", i, j)
+			}
+			res, err := server.ResolveSearch(sse.SearchToken(step.SearchToken))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(res, step.SearchResult) {
+				t.Errorf("flow %d, step %d: search result differs", i, j)
+			}
+			ids, err := client.OpenResult(step.Query, sse.SearchResult(step.SearchResult))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids, step.FileIDs) && (len(ids) != 0 || len(step.FileIDs) != 0) {
+				t.Errorf("flow %d, step %d: got files %v, want %v", i, j, ids, step.FileIDs)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package emys
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// WAL makes a volatile Store crash-safe between snapshots. Every batch, be it
+// the entries of ResolveUpdates or the compaction of ResolveSearch, is logged
+// as a single record and synced before the wrapped store applies it, so that
+// a crash never leaves a half-applied batch behind.
+//
+// On restart, the wrapped store must first be brought back to the last
+// checkpoint, for example by loading its snapshot with Server.LoadState, and
+// only then be passed to OpenWAL, which replays the batches logged since.
+// Replaying a batch twice is harmless, since batches only put and delete
+// fixed entries.
+type WAL struct {
+	mu    sync.Mutex
+	store Store
+	f     *os.File
+	size  int64
+}
+
+var _ Store = &WAL{}
+
+// OpenWAL opens the log at path, creating it if needed, and applies its
+// batches to store.
+func OpenWAL(path string, store Store) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	size, err := replayLog(f, func(_ int64, payload []byte) error {
+		b, err := readLogBatch(payload)
+		if err != nil {
+			return err
+		}
+		if err := store.Apply(b); err != nil {
+			return fmt.Errorf("failed to replay batch: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &WAL{store: store, f: f, size: size}, nil
+}
+
+func (w *WAL) Get(key []byte) (Entry, bool, error) {
+	return w.store.Get(key)
+}
+
+func (w *WAL) Keys(fn func(key []byte) error) error {
+	return w.store.Keys(fn)
+}
+
+func (w *WAL) Put(key []byte, entry Entry) error {
+	var b Batch
+	b.Put(key, entry)
+	return w.Apply(&b)
+}
+
+func (w *WAL) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return w.Apply(&b)
+}
+
+func (w *WAL) Apply(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	payload := appendLogBatch(nil, b)
+	if len(payload) > logMaxRecordSize {
+		return fmt.Errorf("batch too large: %d bytes", len(payload))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("write-ahead log closed")
+	}
+	return w.apply(b, payload)
+}
+
+// Transact keeps other batches from being logged while fn reads the wrapped
+// store, which only the WAL writes to.
+func (w *WAL) Transact(fn func(get GetFunc) (*Batch, error)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("write-ahead log closed")
+	}
+	b, err := fn(w.store.Get)
+	if err != nil {
+		return err
+	}
+	if b == nil || b.Len() == 0 {
+		return nil
+	}
+	payload := appendLogBatch(nil, b)
+	if len(payload) > logMaxRecordSize {
+		return fmt.Errorf("batch too large: %d bytes", len(payload))
+	}
+	return w.apply(b, payload)
+}
+
+func (w *WAL) apply(b *Batch, payload []byte) error {
+	if _, err := w.f.WriteAt(appendLogRecord(nil, payload), w.size); err != nil {
+		w.f.Truncate(w.size)
+		return fmt.Errorf("failed to append record: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Truncate(w.size)
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	if err := w.store.Apply(b); err != nil {
+		// The batch must not resurface on replay, since it never took effect.
+		if err := w.f.Truncate(w.size); err != nil {
+			return fmt.Errorf("failed to drop unapplied record: %w", err)
+		}
+		return err
+	}
+	w.size += logHeaderSize + int64(len(payload))
+	return nil
+}
+
+// Checkpoint calls snapshot, which should durably save the content of the
+// wrapped store, typically with Server.State, and then empties the log. No
+// batch is applied in the meantime, so the snapshot and the log never miss
+// or overlap a batch.
+func (w *WAL) Checkpoint(snapshot func() error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("write-ahead log closed")
+	}
+	if err := snapshot(); err != nil {
+		return fmt.Errorf("failed to take snapshot: %w", err)
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	w.size = 0
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,118 @@
+package emys_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/sse"
+)
+
+func TestWAL(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "wal")
+	config := &emys.Config{
+		MaxFiles:          100,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClient(key, nonce, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot []byte
+
+	// restart rebuilds a server from the last snapshot and the log.
+	restart := func() (*emys.Server, *emys.WAL) {
+		store := emys.NewMemoryStore()
+		if snapshot != nil {
+			loader, err := emys.NewServerWithStore(config, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := loader.LoadState(snapshot); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wal, err := emys.OpenWAL(walPath, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := emys.NewServerWithStore(config, wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server, wal
+	}
+	update := func(server *emys.Server, id uint64, text string) {
+		utoks, err := client.Update(sse.Change[uint64]{FileID: id, Diff: emys.Diff(nil, []byte(text))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ResolveUpdates(utoks...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	search := func(server *emys.Server, query string) []uint64 {
+		stok, err := client.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := server.ResolveSearch(stok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := client.OpenResult(query, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	server, wal := restart()
+	update(server, 1, "Hello, Gopher!")
+	update(server, 2, "Gophers everywhere")
+	err = wal.Checkpoint(func() error {
+		snapshot, err = server.State()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(server, 3, "Hello, 世界")
+	update(server, 4, "Gopher")
+	wal.Close()
+
+	// A crash after the checkpoint loses nothing.
+	server, wal = restart()
+	if got := search(server, "Gopher"); !slices.Equal(got, []uint64{1, 2, 4}) {
+		t.Errorf("after restart: got %v, want [1 2 4]", got)
+	}
+	if got := search(server, "Hello"); !slices.Equal(got, []uint64{1, 3}) {
+		t.Errorf("after restart: got %v, want [1 3]", got)
+	}
+	wal.Close()
+
+	// Neither does a crash while the last compaction was being logged: its
+	// torn record is discarded, and the chains it would have replaced are
+	// still in place.
+	log, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(walPath, log[:len(log)-5], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server, wal = restart()
+	defer wal.Close()
+	if got := search(server, "Hello"); !slices.Equal(got, []uint64{1, 3}) {
+		t.Errorf("after torn compaction: got %v, want [1 3]", got)
+	}
+	if got := search(server, "Gopher"); !slices.Equal(got, []uint64{1, 2, 4}) {
+		t.Errorf("after torn compaction: got %v, want [1 2 4]", got)
+	}
+}
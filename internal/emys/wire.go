@@ -0,0 +1,243 @@
+package emys
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Update, search and check tokens and search results have an encoding of
+// their own, while other tokens and results are gob encodings. Gob numbers types in
+// the order a process first meets them, so it would not fix the bytes that
+// the vectors pin down for other implementations.
+//
+// Fields follow each other in declaration order: byte strings prefixed by
+// their length, and integers as varints. Lists are prefixed by their length
+// too. An empty byte string decodes as nil.
+
+func appendWireBytes(b, x []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(x)))
+	return append(b, x...)
+}
+
+// wireReader decodes fields one after the other, and keeps the first error.
+type wireReader struct {
+	b   []byte
+	err error
+}
+
+var errTruncatedField = errors.New("truncated field")
+
+func (r *wireReader) bytes() []byte {
+	n := r.uint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.b)) < n {
+		r.err = errTruncatedField
+		return nil
+	}
+	x := r.b[:n]
+	r.b = r.b[n:]
+	if n == 0 {
+		return nil
+	}
+	return slices.Clone(x)
+}
+
+func (r *wireReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errTruncatedField
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *wireReader) int() int64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errTruncatedField
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+// count reads the length of a list whose items take at least size bytes
+// each, so that a bogus length is caught before anything is allocated.
+func (r *wireReader) count(size int) int {
+	n := r.uint()
+	if r.err == nil && n > uint64(len(r.b)/size) {
+		r.err = fmt.Errorf("list of %d items in %d bytes", n, len(r.b))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *wireReader) close() error {
+	if r.err == nil && len(r.b) != 0 {
+		return fmt.Errorf("%d trailing bytes", len(r.b))
+	}
+	return r.err
+}
+
+func encodeUpdateToken(utok updateToken) []byte {
+	var b []byte
+	b = appendWireBytes(b, utok.Config)
+	b = binary.AppendUvarint(b, utok.Epoch)
+	b = binary.AppendUvarint(b, utok.Segment)
+	b = appendWireBytes(b, utok.NextInternalUpdateToken)
+	b = appendWireBytes(b, utok.MaskedInternalSearchToken)
+	b = appendWireBytes(b, utok.EncryptedIndex)
+	b = appendWireBytes(b, utok.Tag)
+	b = appendWireBytes(b, utok.Device)
+	b = appendWireBytes(b, utok.Log)
+	return appendWireBytes(b, utok.NextLog)
+}
+
+func decodeUpdateToken(token []byte, max int) (updateToken, error) {
+	if len(token) > max {
+		return updateToken{}, fmt.Errorf("%w: update token too large: %d bytes", ErrMalformedToken, len(token))
+	}
+	r := &wireReader{b: token}
+	utok := updateToken{
+		Config:                    r.bytes(),
+		Epoch:                     r.uint(),
+		Segment:                   r.uint(),
+		NextInternalUpdateToken:   r.bytes(),
+		MaskedInternalSearchToken: r.bytes(),
+		EncryptedIndex:            r.bytes(),
+		Tag:                       r.bytes(),
+		Device:                    r.bytes(),
+		Log:                       r.bytes(),
+		NextLog:                   r.bytes(),
+	}
+	if err := r.close(); err != nil {
+		return updateToken{}, fmt.Errorf("%w: failed to decode update token: %w", ErrMalformedToken, err)
+	}
+	return utok, nil
+}
+
+// searchTokenMinSize is the size of an encoded search token with empty
+// fields.
+const searchTokenMinSize = 6
+
+func encodeSearchTokens(stok []searchToken) []byte {
+	return appendSearchTokens(nil, stok)
+}
+
+func appendSearchTokens(b []byte, stok []searchToken) []byte {
+	b = binary.AppendUvarint(b, uint64(len(stok)))
+	for _, tok := range stok {
+		b = appendWireBytes(b, tok.Config)
+		b = binary.AppendUvarint(b, tok.Epoch)
+		b = binary.AppendUvarint(b, tok.Segment)
+		b = binary.AppendVarint(b, tok.UpdateCount)
+		b = appendWireBytes(b, tok.InternalSearchToken)
+		b = appendWireBytes(b, tok.UpdateKey)
+	}
+	return b
+}
+
+// decodeSearchTokens decodes the chains of a search or compaction token,
+// unless it is larger than max bytes.
+func decodeSearchTokens(token []byte, max int, what string) ([]searchToken, error) {
+	if len(token) > max {
+		return nil, fmt.Errorf("%w: %s too large: %d bytes", ErrMalformedToken, what, len(token))
+	}
+	r := &wireReader{b: token}
+	stok := r.searchTokens(r.count(searchTokenMinSize))
+	if err := r.close(); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode %s: %w", ErrMalformedToken, what, err)
+	}
+	return stok, nil
+}
+
+func (r *wireReader) searchTokens(n int) []searchToken {
+	stok := make([]searchToken, n)
+	for i := range stok {
+		stok[i] = searchToken{
+			Config:              r.bytes(),
+			Epoch:               r.uint(),
+			Segment:             r.uint(),
+			UpdateCount:         r.int(),
+			InternalSearchToken: r.bytes(),
+			UpdateKey:           r.bytes(),
+		}
+	}
+	return stok
+}
+
+// A check token lists the chains of every trigram, as search tokens do.
+func encodeCheckToken(stok [][]searchToken) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(stok)))
+	for _, chains := range stok {
+		b = appendSearchTokens(b, chains)
+	}
+	return b
+}
+
+// decodeCheckToken checks the number of trigrams, and of chains for each
+// trigram and in all, before it decodes them, so that a token within
+// maxCheckTokenSize can't make it allocate much more than that.
+func decodeCheckToken(token []byte, maxChains int) ([][]searchToken, error) {
+	if len(token) > maxCheckTokenSize {
+		return nil, fmt.Errorf("%w: check token too large: %d bytes", ErrMalformedToken, len(token))
+	}
+	r := &wireReader{b: token}
+	n := r.count(1)
+	if n > maxCheckTrigrams {
+		return nil, fmt.Errorf("%w: too many trigrams in check token: %d", ErrMalformedToken, n)
+	}
+	stok := make([][]searchToken, n)
+	var total int
+	for i := range stok {
+		n := r.count(searchTokenMinSize)
+		if n > maxChains {
+			return nil, fmt.Errorf("%w: too many chains for a trigram in check token: %d", ErrMalformedToken, n)
+		}
+		if total += n; total > maxCheckChains {
+			return nil, fmt.Errorf("%w: too many chains in check token: %d", ErrMalformedToken, total)
+		}
+		stok[i] = r.searchTokens(n)
+	}
+	if err := r.close(); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode check token: %w", ErrMalformedToken, err)
+	}
+	return stok, nil
+}
+
+func encodeSearchResult(res searchResult) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(res.Segments)))
+	for _, seg := range res.Segments {
+		b = binary.AppendUvarint(b, seg.Segment)
+		b = appendWireBytes(b, seg.EncryptedIndex)
+		b = appendWireBytes(b, seg.Tag)
+	}
+	return b
+}
+
+func decodeSearchResult(result []byte) (searchResult, error) {
+	r := &wireReader{b: result}
+	res := searchResult{Segments: make([]segmentResult, r.count(3))}
+	for i := range res.Segments {
+		res.Segments[i] = segmentResult{
+			Segment:        r.uint(),
+			EncryptedIndex: r.bytes(),
+			Tag:            r.bytes(),
+		}
+	}
+	if err := r.close(); err != nil {
+		return searchResult{}, fmt.Errorf("%w: failed to decode search result: %w", ErrMalformedResult, err)
+	}
+	return res, nil
+}
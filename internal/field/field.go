@@ -0,0 +1,283 @@
+// Package field implements constant-time arithmetic modulo the prime
+// p = 2²⁵⁶ + 2⁹⁶ - 1, over which the index blocks and tags are defined.
+package field
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+)
+
+// Size is the length of the big-endian encoding of an element.
+const Size = 33
+
+const limbs = 5
+
+// Element is an integer modulo p, as little-endian 64-bit limbs. The zero
+// value is a valid zero element.
+type Element struct {
+	l [limbs]uint64
+}
+
+var p = [limbs]uint64{0xffffffffffffffff, 0x00000000ffffffff, 0, 0, 1}
+
+// rr is R² mod p, with R = 2³²⁰, used to move in and out of the Montgomery
+// domain.
+var rr Element
+
+func init() {
+	r := new(big.Int).Lsh(big.NewInt(1), 64*limbs)
+	r.Mul(r, r).Mod(r, Modulus())
+	if _, err := rr.SetBytes(r.FillBytes(make([]byte, Size))); err != nil {
+		panic(fmt.Sprintf("field: failed to initialize R²: %v", err))
+	}
+}
+
+// Modulus returns p as a new big.Int.
+func Modulus() *big.Int {
+	m := new(big.Int).Lsh(big.NewInt(1), 256)
+	m.Add(m, new(big.Int).Lsh(big.NewInt(1), 96))
+	return m.Sub(m, big.NewInt(1))
+}
+
+var errUnreduced = errors.New("value not reduced modulo p")
+
+// SetBytes sets e to the big-endian value of b, which must be exactly Size
+// bytes long and less than p.
+func (e *Element) SetBytes(b []byte) (*Element, error) {
+	if len(b) != Size {
+		return nil, fmt.Errorf("invalid element length: %d", len(b))
+	}
+	var l [limbs]uint64
+	l[4] = uint64(b[0])
+	l[3] = binary.BigEndian.Uint64(b[1:9])
+	l[2] = binary.BigEndian.Uint64(b[9:17])
+	l[1] = binary.BigEndian.Uint64(b[17:25])
+	l[0] = binary.BigEndian.Uint64(b[25:33])
+	var borrow uint64
+	for i := range limbs {
+		_, borrow = bits.Sub64(l[i], p[i], borrow)
+	}
+	if borrow == 0 {
+		return nil, errUnreduced
+	}
+	e.l = l
+	return e, nil
+}
+
+// FillBytes writes the big-endian encoding of e to b, which must be exactly
+// Size bytes long.
+func (e *Element) FillBytes(b []byte) []byte {
+	if len(b) != Size {
+		panic("field: invalid buffer length")
+	}
+	b[0] = byte(e.l[4])
+	binary.BigEndian.PutUint64(b[1:9], e.l[3])
+	binary.BigEndian.PutUint64(b[9:17], e.l[2])
+	binary.BigEndian.PutUint64(b[17:25], e.l[1])
+	binary.BigEndian.PutUint64(b[25:33], e.l[0])
+	return b
+}
+
+func (e *Element) Bytes() []byte {
+	return e.FillBytes(make([]byte, Size))
+}
+
+// Equal returns 1 if e and t are equal, and 0 otherwise.
+func (e *Element) Equal(t *Element) int {
+	var d uint64
+	for i := range limbs {
+		d |= e.l[i] ^ t.l[i]
+	}
+	return int(1 ^ (d|-d)>>63)
+}
+
+// Add sets e = a + b mod p and returns e.
+func (e *Element) Add(a, b *Element) *Element {
+	var s [limbs]uint64
+	var carry uint64
+	for i := range limbs {
+		s[i], carry = bits.Add64(a.l[i], b.l[i], carry)
+	}
+	e.l = reduce(s)
+	return e
+}
+
+// Sub sets e = a - b mod p and returns e.
+func (e *Element) Sub(a, b *Element) *Element {
+	var d [limbs]uint64
+	var borrow uint64
+	for i := range limbs {
+		d[i], borrow = bits.Sub64(a.l[i], b.l[i], borrow)
+	}
+	mask := -borrow
+	var carry uint64
+	for i := range limbs {
+		d[i], carry = bits.Add64(d[i], p[i]&mask, carry)
+	}
+	e.l = d
+	return e
+}
+
+// Neg sets e = -a mod p and returns e.
+func (e *Element) Neg(a *Element) *Element {
+	return e.Sub(new(Element), a)
+}
+
+// Mul sets e = a · b mod p and returns e.
+func (e *Element) Mul(a, b *Element) *Element {
+	var t Element
+	montMul(&t, a, b)
+	montMul(e, &t, &rr)
+	return e
+}
+
+// reduce returns s - p if s ≥ p, and s otherwise, for s < 2p.
+func reduce(s [limbs]uint64) [limbs]uint64 {
+	var t [limbs]uint64
+	var borrow uint64
+	for i := range limbs {
+		t[i], borrow = bits.Sub64(s[i], p[i], borrow)
+	}
+	mask := -borrow
+	for i := range limbs {
+		t[i] = s[i]&mask | t[i]&^mask
+	}
+	return t
+}
+
+// montMul sets e = a · b · R⁻¹ mod p, with the CIOS method. Since p ≡ -1
+// mod 2⁶⁴, -p⁻¹ mod 2⁶⁴ is 1 and every reduction factor is just the lowest
+// limb of the accumulator.
+func montMul(e, a, b *Element) {
+	var t [limbs + 2]uint64
+	for i := range limbs {
+		var c uint64
+		for j := range limbs {
+			t[j], c = mulAdd(a.l[j], b.l[i], t[j], c)
+		}
+		t[limbs], c = bits.Add64(t[limbs], c, 0)
+		t[limbs+1] = c
+
+		m := t[0]
+		_, c = mulAdd(m, p[0], t[0], 0)
+		for j := 1; j < limbs; j++ {
+			t[j-1], c = mulAdd(m, p[j], t[j], c)
+		}
+		t[limbs-1], c = bits.Add64(t[limbs], c, 0)
+		t[limbs] = t[limbs+1] + c
+	}
+	// The result is below 2p, so it takes at most one more limb than p and
+	// at most one subtraction.
+	var r [limbs]uint64
+	var borrow uint64
+	for i := range limbs {
+		r[i], borrow = bits.Sub64(t[i], p[i], borrow)
+	}
+	_, borrow = bits.Sub64(t[limbs], 0, borrow)
+	mask := -borrow
+	for i := range limbs {
+		e.l[i] = t[i]&mask | r[i]&^mask
+	}
+}
+
+// mulAdd returns the low and high words of x · y + z + c.
+func mulAdd(x, y, z, c uint64) (lo, hi uint64) {
+	hi, lo = bits.Mul64(x, y)
+	var carry uint64
+	lo, carry = bits.Add64(lo, z, 0)
+	hi += carry
+	lo, carry = bits.Add64(lo, c, 0)
+	hi += carry
+	return lo, hi
+}
+
+func checkSlices(x, y []byte) error {
+	if len(x) != len(y) {
+		return fmt.Errorf("slices have different lengths")
+	}
+	if len(x)%Size != 0 {
+		return fmt.Errorf("slice length is not a multiple of the element size")
+	}
+	return nil
+}
+
+// AddSlice sets dst = x + y element by element. The slices hold concatenated
+// encoded elements and dst may alias x or y.
+func AddSlice(dst, x, y []byte) error {
+	if err := checkSlices(x, y); err != nil {
+		return err
+	}
+	if err := checkSlices(dst, x); err != nil {
+		return err
+	}
+	var a, b Element
+	for i := 0; i < len(x); i += Size {
+		if _, err := a.SetBytes(x[i : i+Size]); err != nil {
+			return fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		if _, err := b.SetBytes(y[i : i+Size]); err != nil {
+			return fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		a.Add(&a, &b).FillBytes(dst[i : i+Size])
+	}
+	return nil
+}
+
+// SubSlice sets dst = x - y element by element, like AddSlice.
+func SubSlice(dst, x, y []byte) error {
+	if err := checkSlices(x, y); err != nil {
+		return err
+	}
+	if err := checkSlices(dst, x); err != nil {
+		return err
+	}
+	var a, b Element
+	for i := 0; i < len(x); i += Size {
+		if _, err := a.SetBytes(x[i : i+Size]); err != nil {
+			return fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		if _, err := b.SetBytes(y[i : i+Size]); err != nil {
+			return fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		a.Sub(&a, &b).FillBytes(dst[i : i+Size])
+	}
+	return nil
+}
+
+// NegSlice sets dst = -x element by element, like AddSlice.
+func NegSlice(dst, x []byte) error {
+	if err := checkSlices(dst, x); err != nil {
+		return err
+	}
+	var a, zero Element
+	for i := 0; i < len(x); i += Size {
+		if _, err := a.SetBytes(x[i : i+Size]); err != nil {
+			return fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		a.Sub(&zero, &a).FillBytes(dst[i : i+Size])
+	}
+	return nil
+}
+
+// Horner sets e = (…((e + m₀) · k + m₁) · k + …) · k for the elements mᵢ
+// concatenated in msg, and returns e.
+func (e *Element) Horner(k *Element, msg []byte) (*Element, error) {
+	if len(msg)%Size != 0 {
+		return nil, fmt.Errorf("message length is not a multiple of the element size")
+	}
+	var kr, m Element
+	montMul(&kr, k, &rr)
+	t := *e
+	for i := 0; i < len(msg); i += Size {
+		if _, err := m.SetBytes(msg[i : i+Size]); err != nil {
+			return nil, fmt.Errorf("element %d: %w", i/Size, err)
+		}
+		t.Add(&t, &m)
+		montMul(&t, &t, &kr)
+	}
+	*e = t
+	return e, nil
+}
@@ -0,0 +1,163 @@
+package field_test
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand/v2"
+	"testing"
+
+	"interrato.dev/emys/internal/field"
+)
+
+func TestModulus(t *testing.T) {
+	if !field.Modulus().ProbablyPrime(32) {
+		t.Fatal("modulus is not prime")
+	}
+	if size := (field.Modulus().BitLen() + 7) / 8; size != field.Size {
+		t.Fatalf("modulus size does not match Size: %d", size)
+	}
+	if _, err := new(field.Element).SetBytes(field.Modulus().FillBytes(make([]byte, field.Size))); err == nil {
+		t.Error("SetBytes accepted p")
+	}
+	max := new(big.Int).Lsh(big.NewInt(1), 8*field.Size)
+	max.Sub(max, big.NewInt(1))
+	if _, err := new(field.Element).SetBytes(max.FillBytes(make([]byte, field.Size))); err == nil {
+		t.Error("SetBytes accepted 2²⁶⁴-1")
+	}
+}
+
+func testValues(r *rand.Rand) []*big.Int {
+	p := field.Modulus()
+	one := big.NewInt(1)
+	values := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(2),
+		new(big.Int).Sub(p, one),
+		new(big.Int).Sub(p, big.NewInt(2)),
+		new(big.Int).Lsh(one, 256),
+		new(big.Int).Sub(new(big.Int).Lsh(one, 256), one),
+		new(big.Int).Lsh(one, 96),
+		new(big.Int).Sub(new(big.Int).Lsh(one, 96), one),
+		new(big.Int).Lsh(one, 64),
+	}
+	for range 40 {
+		b := make([]byte, field.Size)
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		values = append(values, new(big.Int).Mod(new(big.Int).SetBytes(b), p))
+	}
+	return values
+}
+
+func element(t *testing.T, x *big.Int) *field.Element {
+	e, err := new(field.Element).SetBytes(x.FillBytes(make([]byte, field.Size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestArithmetic(t *testing.T) {
+	p := field.Modulus()
+	values := testValues(rand.New(rand.NewPCG(1, 2)))
+	for _, x := range values {
+		for _, y := range values {
+			a, b := element(t, x), element(t, y)
+			ops := []struct {
+				name string
+				got  *field.Element
+				want *big.Int
+			}{
+				{"Add", new(field.Element).Add(a, b), new(big.Int).Add(x, y)},
+				{"Sub", new(field.Element).Sub(a, b), new(big.Int).Sub(x, y)},
+				{"Mul", new(field.Element).Mul(a, b), new(big.Int).Mul(x, y)},
+				{"Neg", new(field.Element).Neg(a), new(big.Int).Neg(x)},
+			}
+			for _, op := range ops {
+				want := op.want.Mod(op.want, p).FillBytes(make([]byte, field.Size))
+				if got := op.got.Bytes(); !bytes.Equal(got, want) {
+					t.Errorf("%s(%x, %x) = %x, want %x", op.name, x, y, got, want)
+				}
+			}
+			if eq := a.Equal(b); eq != 1 && x.Cmp(y) == 0 || eq != 0 && x.Cmp(y) != 0 {
+				t.Errorf("Equal(%x, %x) = %d", x, y, eq)
+			}
+		}
+	}
+}
+
+func TestSlices(t *testing.T) {
+	p := field.Modulus()
+	values := testValues(rand.New(rand.NewPCG(3, 4)))
+	var x, y []byte
+	for i, v := range values {
+		x = append(x, v.FillBytes(make([]byte, field.Size))...)
+		y = append(y, values[len(values)-1-i].FillBytes(make([]byte, field.Size))...)
+	}
+	sum := make([]byte, len(x))
+	if err := field.AddSlice(sum, x, y); err != nil {
+		t.Fatal(err)
+	}
+	diff := make([]byte, len(x))
+	if err := field.SubSlice(diff, x, y); err != nil {
+		t.Fatal(err)
+	}
+	neg := bytes.Clone(x)
+	if err := field.NegSlice(neg, neg); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		w := values[len(values)-1-i]
+		block := func(b []byte) []byte { return b[i*field.Size : (i+1)*field.Size] }
+		if want := new(big.Int).Mod(new(big.Int).Add(v, w), p); !bytes.Equal(block(sum), want.FillBytes(make([]byte, field.Size))) {
+			t.Errorf("AddSlice element %d = %x, want %x", i, block(sum), want)
+		}
+		if want := new(big.Int).Mod(new(big.Int).Sub(v, w), p); !bytes.Equal(block(diff), want.FillBytes(make([]byte, field.Size))) {
+			t.Errorf("SubSlice element %d = %x, want %x", i, block(diff), want)
+		}
+		if want := new(big.Int).Mod(new(big.Int).Neg(v), p); !bytes.Equal(block(neg), want.FillBytes(make([]byte, field.Size))) {
+			t.Errorf("NegSlice element %d = %x, want %x", i, block(neg), want)
+		}
+	}
+
+	k := values[len(values)-1]
+	acc := big.NewInt(0)
+	for _, v := range values {
+		acc.Add(acc, v).Mul(acc, k).Mod(acc, p)
+	}
+	got, err := new(field.Element).Horner(element(t, k), x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := acc.FillBytes(make([]byte, field.Size)); !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Horner = %x, want %x", got.Bytes(), want)
+	}
+
+	if err := field.AddSlice(sum, x, y[field.Size:]); err == nil {
+		t.Error("AddSlice accepted slices of different lengths")
+	}
+}
+
+func BenchmarkAddSlice(b *testing.B) {
+	x := make([]byte, field.Size*1024)
+	y := make([]byte, field.Size*1024)
+	b.SetBytes(int64(len(x)))
+	for b.Loop() {
+		if err := field.AddSlice(x, x, y); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHorner(b *testing.B) {
+	msg := make([]byte, field.Size*1024)
+	k := new(field.Element)
+	b.SetBytes(int64(len(msg)))
+	for b.Loop() {
+		if _, err := new(field.Element).Horner(k, msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package keyfile stores the master key and user nonce of an emys client in a
+// file encrypted under a passphrase.
+//
+// A key file is a fixed header followed by the sealed secrets:
+//
+//	magic      "emyskey\n"
+//	version    1 byte, currently 1
+//	time       4 bytes, Argon2id passes
+//	memory     4 bytes, Argon2id memory in KiB
+//	threads    1 byte, Argon2id parallelism
+//	salt       16 bytes
+//	nonce      24 bytes
+//	ciphertext XChaCha20-Poly1305 of key and user nonce, with the header as
+//	           additional data
+//
+// Integers are big-endian.
+package keyfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	magic   = "emyskey\n"
+	Version = 1
+
+	KeySize       = 32
+	UserNonceSize = 24
+
+	saltSize   = 16
+	headerSize = len(magic) + 1 + 4 + 4 + 1 + saltSize + chacha20poly1305.NonceSizeX
+	secretSize = KeySize + UserNonceSize
+	fileSize   = headerSize + secretSize + chacha20poly1305.Overhead
+)
+
+// ErrPassphrase is returned when a key file can't be opened, either because
+// the passphrase is wrong or because the file was modified.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted key file")
+
+// Params are the Argon2id parameters deriving the file key from the
+// passphrase.
+type Params struct {
+	Time    uint32 // passes over memory
+	Memory  uint32 // KiB, at most 4 GiB
+	Threads uint8
+}
+
+// DefaultParams follow the second recommended option of RFC 9106.
+var DefaultParams = Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+func (p Params) validate() error {
+	if p.Time == 0 || p.Time > 1000 {
+		return fmt.Errorf("invalid number of passes: %d", p.Time)
+	}
+	if p.Threads == 0 {
+		return fmt.Errorf("invalid number of threads: %d", p.Threads)
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > 4*1024*1024 {
+		return fmt.Errorf("invalid memory size: %d KiB", p.Memory)
+	}
+	return nil
+}
+
+// File is a parsed key file, whose secrets are still sealed.
+type File struct {
+	Version uint8
+	Params  Params
+
+	header     []byte
+	salt       []byte
+	nonce      []byte
+	ciphertext []byte
+}
+
+// Parse checks the header of a key file without opening it.
+func Parse(data []byte) (*File, error) {
+	if len(data) < len(magic) || string(data[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not a key file")
+	}
+	if len(data) < len(magic)+1 {
+		return nil, fmt.Errorf("truncated key file")
+	}
+	if v := data[len(magic)]; v != Version {
+		return nil, fmt.Errorf("unsupported key file version: %d", v)
+	}
+	if len(data) != fileSize {
+		return nil, fmt.Errorf("invalid key file size: %d", len(data))
+	}
+	b := data[len(magic)+1:]
+	f := &File{
+		Version: Version,
+		Params: Params{
+			Time:    binary.BigEndian.Uint32(b[0:4]),
+			Memory:  binary.BigEndian.Uint32(b[4:8]),
+			Threads: b[8],
+		},
+		header: data[:headerSize],
+	}
+	b = b[9:]
+	f.salt, b = b[:saltSize], b[saltSize:]
+	f.nonce, b = b[:chacha20poly1305.NonceSizeX], b[chacha20poly1305.NonceSizeX:]
+	f.ciphertext = b
+	if err := f.Params.validate(); err != nil {
+		return nil, fmt.Errorf("invalid key file parameters: %w", err)
+	}
+	return f, nil
+}
+
+// Open decrypts the master key and user nonce of the file.
+func (f *File) Open(passphrase []byte) (key, userNonce []byte, err error) {
+	aead, err := chacha20poly1305.NewX(fileKey(passphrase, f.salt, f.Params))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize aead cipher: %w", err)
+	}
+	secret, err := aead.Open(nil, f.nonce, f.ciphertext, f.header)
+	if err != nil {
+		return nil, nil, ErrPassphrase
+	}
+	return secret[:KeySize], secret[KeySize:], nil
+}
+
+// Open parses a key file and decrypts its secrets.
+func Open(data, passphrase []byte) (key, userNonce []byte, err error) {
+	f, err := Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.Open(passphrase)
+}
+
+// Seal encrypts a master key and user nonce under a passphrase.
+func Seal(key, userNonce, passphrase []byte, params Params) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key size must be exactly %d bytes", KeySize)
+	}
+	if len(userNonce) != UserNonceSize {
+		return nil, fmt.Errorf("nonce size must be exactly %d bytes", UserNonceSize)
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, fileSize)
+	data = append(data, magic...)
+	data = append(data, Version)
+	data = binary.BigEndian.AppendUint32(data, params.Time)
+	data = binary.BigEndian.AppendUint32(data, params.Memory)
+	data = append(data, params.Threads)
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	data = append(data, salt...)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	data = append(data, nonce...)
+	aead, err := chacha20poly1305.NewX(fileKey(passphrase, salt, params))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize aead cipher: %w", err)
+	}
+	secret := append(bytes.Clone(key), userNonce...)
+	return aead.Seal(data, nonce, secret, data), nil
+}
+
+// Generate returns a key file holding a fresh random master key and user
+// nonce.
+func Generate(passphrase []byte, params Params) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	userNonce := make([]byte, UserNonceSize)
+	if _, err := rand.Read(userNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate user nonce: %w", err)
+	}
+	return Seal(key, userNonce, passphrase, params)
+}
+
+// ChangePassphrase re-encrypts the secrets of a key file under a new
+// passphrase, with fresh salt and the given parameters.
+func ChangePassphrase(data, oldPassphrase, newPassphrase []byte, params Params) ([]byte, error) {
+	key, userNonce, err := Open(data, oldPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	return Seal(key, userNonce, newPassphrase, params)
+}
+
+func fileKey(passphrase, salt []byte, params Params) []byte {
+	return argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+}
@@ -0,0 +1,119 @@
+package keyfile_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"interrato.dev/emys/internal/emys"
+	"interrato.dev/emys/internal/keyfile"
+)
+
+var testParams = keyfile.Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestKeyFile(t *testing.T) {
+	key := []byte("YELLOW SUBMARINE, BLACK WIZARDRY")
+	nonce := []byte("THIS USER IS FOR TESTING")
+	data, err := keyfile.Seal(key, nonce, []byte("correct horse"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := keyfile.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != keyfile.Version || f.Params != testParams {
+		t.Errorf("Parse() = version %d, params %+v", f.Version, f.Params)
+	}
+	gotKey, gotNonce, err := f.Open([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotKey, key) || !bytes.Equal(gotNonce, nonce) {
+		t.Error("opened secrets differ from sealed ones")
+	}
+	if _, _, err := f.Open([]byte("battery staple")); !errors.Is(err, keyfile.ErrPassphrase) {
+		t.Errorf("Open() with wrong passphrase error = %v, want ErrPassphrase", err)
+	}
+
+	// The header is authenticated, so weakening the parameters is caught.
+	tampered := bytes.Clone(data)
+	tampered[len("emyskey\n")+4]++
+	if _, _, err := keyfile.Open(tampered, []byte("correct horse")); !errors.Is(err, keyfile.ErrPassphrase) {
+		t.Errorf("Open() of tampered file error = %v, want ErrPassphrase", err)
+	}
+	future := bytes.Clone(data)
+	future[len("emyskey\n")] = keyfile.Version + 1
+	if _, err := keyfile.Parse(future); err == nil {
+		t.Error("unsupported version accepted")
+	}
+	if _, err := keyfile.Parse(data[:len(data)-1]); err == nil {
+		t.Error("truncated file accepted")
+	}
+
+	changed, err := keyfile.ChangePassphrase(data, []byte("correct horse"), []byte("battery staple"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := keyfile.Open(changed, []byte("correct horse")); !errors.Is(err, keyfile.ErrPassphrase) {
+		t.Errorf("old passphrase error = %v, want ErrPassphrase", err)
+	}
+	gotKey, gotNonce, err = keyfile.Open(changed, []byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotKey, key) || !bytes.Equal(gotNonce, nonce) {
+		t.Error("secrets changed with the passphrase")
+	}
+}
+
+func TestNewClientFromKeyFile(t *testing.T) {
+	data, err := keyfile.Generate([]byte("correct horse"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &emys.Config{
+		MaxFiles:          10,
+		MaxSearchTrigrams: 10,
+		SearchThreshold:   0.75,
+	}
+	client, err := emys.NewClientFromKeyFile(data, []byte("correct horse"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := client.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same file opens a client that can read the state of the first.
+	other, err := emys.NewClientFromKeyFile(data, []byte("correct horse"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emys.NewClientFromKeyFile(data, []byte("battery staple"), config); !errors.Is(err, keyfile.ErrPassphrase) {
+		t.Errorf("wrong passphrase error = %v, want ErrPassphrase", err)
+	}
+}
+
+func FuzzOpen(f *testing.F) {
+	data, err := keyfile.Seal([]byte("YELLOW SUBMARINE, BLACK WIZARDRY"), []byte("THIS USER IS FOR TESTING"), []byte("correct horse"), testParams)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := keyfile.Parse(data)
+		if err != nil {
+			return
+		}
+		// Parameters are bounded, but still keep the fuzzer fast.
+		if file.Params.Memory > 1024 || file.Params.Time > 4 {
+			return
+		}
+		file.Open([]byte("correct horse"))
+	})
+}
@@ -1,5 +1,7 @@
 package sse
 
+import "context"
+
 type Query any
 
 type SearchToken []byte
@@ -11,10 +13,23 @@ type Searcher[T comparable] interface {
 	OpenResult(query Query, result SearchResult) ([]T, error)
 }
 
+// ContextSearcher is a Searcher whose calls can be cancelled. A cancelled call
+// returns the context error and leaves the searcher as it was.
+type ContextSearcher[T comparable] interface {
+	Searcher[T]
+	SearchContext(ctx context.Context, query Query) (SearchToken, error)
+	OpenResultContext(ctx context.Context, query Query, result SearchResult) ([]T, error)
+}
+
 type SearchResolver interface {
 	ResolveSearch(token SearchToken) (SearchResult, error)
 }
 
+type ContextSearchResolver interface {
+	SearchResolver
+	ResolveSearchContext(ctx context.Context, token SearchToken) (SearchResult, error)
+}
+
 type Change[T comparable] struct {
 	FileID T
 	Diff   []byte
@@ -26,6 +41,16 @@ type Updater[T comparable] interface {
 	Update(changes ...Change[T]) ([]UpdateToken, error)
 }
 
+type ContextUpdater[T comparable] interface {
+	Updater[T]
+	UpdateContext(ctx context.Context, changes ...Change[T]) ([]UpdateToken, error)
+}
+
 type UpdateResolver interface {
 	ResolveUpdates(tokens ...UpdateToken) error
 }
+
+type ContextUpdateResolver interface {
+	UpdateResolver
+	ResolveUpdatesContext(ctx context.Context, tokens ...UpdateToken) error
+}